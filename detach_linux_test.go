@@ -0,0 +1,51 @@
+package shell
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// procSid read the session id from /proc/<pid>/stat
+func procSid(pid int) (int, error) {
+	bs, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// the comm field may contain spaces, the fields after ")" are: state ppid pgrp session
+	fields := strings.Fields(string(bs[strings.LastIndex(string(bs), ")")+1:]))
+	var sid int
+	_, err = fmt.Sscanf(fields[3], "%d", &sid)
+	return sid, err
+}
+
+func TestWithDetach(t *testing.T) {
+	cmd := NewCommand("sleep 5", WithDetach())
+	start := time.Now()
+	assert.Nil(t, cmd.Start())
+	cmd.Wait()
+	cmd.Stop()
+	assert.Less(t, time.Since(start).Seconds(), float64(1))
+
+	pid := cmd.Status.PID
+	assert.Greater(t, pid, 0)
+	assert.Equal(t, cmd.Status.Finish, true)
+	defer syscall.Kill(pid, syscall.SIGKILL)
+
+	sid, err := procSid(pid)
+	assert.Nil(t, err)
+	selfSid, err := procSid(os.Getpid())
+	assert.Nil(t, err)
+	assert.Equal(t, sid, pid)
+	assert.NotEqual(t, sid, selfSid)
+
+	// still running after the Cmd is finalized and stopped
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, syscall.Kill(pid, 0))
+}
@@ -0,0 +1,202 @@
+package shell
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// WithEnvFile load the env from a dotenv file and merge into the command env, the parent env is
+// inherited unless WithSetEnv is set before. format: KEY=VALUE per line, `#` comments, quoted values.
+func WithEnvFile(path string) optionFunc {
+	return func(o *Cmd) error {
+		vars, err := parseEnvFile(path)
+		if err != nil {
+			return err
+		}
+
+		env := o.Env
+		if env == nil {
+			env = os.Environ()
+		}
+		for _, kv := range vars {
+			env = setEnv(env, kv[0], kv[1])
+		}
+		o.Env = env
+		return nil
+	}
+}
+
+// WithCaptureEnv set the effective env of the process to Status.Env for debugging,
+// the values are masked like the logs, see WithRedactEnv.
+func WithCaptureEnv() optionFunc {
+	return func(o *Cmd) error {
+		o.captureEnv = true
+		return nil
+	}
+}
+
+// WithPathPrepend prepend dir to PATH of the command, the inherited PATH is kept after it
+func WithPathPrepend(dir string) optionFunc {
+	return func(o *Cmd) error {
+		env := o.Env
+		if env == nil {
+			env = os.Environ()
+		}
+
+		path := dir
+		if origin, ok := getEnv(env, "PATH"); ok && origin != "" {
+			path += string(os.PathListSeparator) + origin
+		}
+		o.Env = setEnv(env, "PATH", path)
+		return nil
+	}
+}
+
+// WithEnvMap set the command env from m in the sorted key order, the map values win over the current env
+// if inherit, the current env is the one set before or the parent env. otherwise the env is exactly m.
+func WithEnvMap(m map[string]string, inherit bool) optionFunc {
+	return func(o *Cmd) error {
+		env := []string{}
+		if inherit {
+			env = o.Env
+			if env == nil {
+				env = os.Environ()
+			}
+		}
+
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			env = setEnv(env, key, m[key])
+		}
+		o.Env = env
+		return nil
+	}
+}
+
+// parseEnvFile return the [key, value] pairs in file order
+func parseEnvFile(path string) ([][2]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Errorf("open env file failed, err: %s", err.Error())
+	}
+	defer file.Close()
+
+	var (
+		vars   [][2]string
+		lineno int
+	)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		idx := strings.Index(line, "=")
+		if idx < 0 {
+			return nil, errors.Errorf("%s:%d: missing '='", path, lineno)
+		}
+		key := strings.TrimSpace(line[:idx])
+		if !envKeyPattern.MatchString(key) {
+			return nil, errors.Errorf("%s:%d: invalid key %q", path, lineno, key)
+		}
+
+		value, err := parseEnvValue(strings.TrimSpace(line[idx+1:]))
+		if err != nil {
+			return nil, errors.Errorf("%s:%d: %s", path, lineno, err.Error())
+		}
+		vars = append(vars, [2]string{key, value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+func parseEnvValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	quote := value[0]
+	if quote != '"' && quote != '\'' {
+		// strip the inline comment
+		if idx := strings.Index(value, " #"); idx >= 0 {
+			value = strings.TrimSpace(value[:idx])
+		}
+		return value, nil
+	}
+
+	end := strings.LastIndexByte(value, quote)
+	if end == 0 {
+		return "", errors.Errorf("unterminated quoted value %s", value)
+	}
+	if rest := strings.TrimSpace(value[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", errors.Errorf("unexpected content after quoted value %s", value)
+	}
+
+	value = value[1:end]
+	if quote == '"' {
+		value = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(value)
+	}
+	return value, nil
+}
+
+// getEnv get the value of key in env, the last one wins like the libc getenv
+func getEnv(env []string, key string) (string, bool) {
+	prefix := key + "="
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], prefix) {
+			return env[i][len(prefix):], true
+		}
+	}
+	return "", false
+}
+
+// lookPathEnv find file in PATH of env, exec.LookPath only searches PATH of the parent
+func lookPathEnv(file string, env []string) (string, error) {
+	path, ok := getEnv(env, "PATH")
+	if !ok || strings.Contains(file, "/") {
+		return exec.LookPath(file)
+	}
+
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		fpath := filepath.Join(dir, file)
+		info, err := os.Stat(fpath)
+		if err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return fpath, nil
+		}
+	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
+
+// setEnv set key=value in env, replace the existing key
+func setEnv(env []string, key, value string) []string {
+	prefix := key + "="
+	out := make([]string, 0, len(env)+1)
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, prefix) {
+			out = append(out, kv)
+		}
+	}
+	return append(out, prefix+value)
+}
@@ -0,0 +1,119 @@
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "go-shell-test")
+	assert.Nil(t, err)
+	defer file.Close()
+
+	_, err = file.WriteString(content)
+	assert.Nil(t, err)
+	return file.Name()
+}
+
+func TestWithEnvFile(t *testing.T) {
+	fpath := writeTempFile(t, `
+# comment
+NAME=xiaorui
+export SITE=xiaorui.cc # inline comment
+GREETING="hello world"
+RAW='$HOME not expanded'
+EMPTY=
+`)
+	defer os.Remove(fpath)
+
+	cmd, err := NewCommandE(`echo -n "$NAME|$SITE|$GREETING|$RAW|$EMPTY|${HOME:+home}"`, WithEnvFile(fpath))
+	assert.Nil(t, err)
+	cmd.Run()
+
+	assert.Equal(t, cmd.Status.Output, "xiaorui|xiaorui.cc|hello world|$HOME not expanded||home")
+}
+
+func TestWithEnvFileMalformed(t *testing.T) {
+	cases := []string{
+		"NAME xiaorui",
+		"1NAME=xiaorui",
+		`NAME="xiaorui`,
+		`NAME="xiaorui" rest`,
+	}
+
+	for _, content := range cases {
+		fpath := writeTempFile(t, "OK=1\n"+content+"\n")
+		_, err := NewCommandE("echo", WithEnvFile(fpath))
+		os.Remove(fpath)
+
+		assert.NotNil(t, err, content)
+		assert.Contains(t, err.Error(), ":2:")
+	}
+
+	_, err := NewCommandE("echo", WithEnvFile("/not-exist-file"))
+	assert.NotNil(t, err)
+}
+
+func TestWithPathPrepend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-shell-bin")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(dir+"/echo", []byte("#!/bin/sh\nprintf 'stub %s' \"$*\"\n"), 0755)
+	assert.Nil(t, err)
+
+	cmd := NewCommand("echo hello", WithExecMode(true), WithPathPrepend(dir))
+	cmd.Run()
+	assert.Nil(t, cmd.Status.Error)
+	assert.Equal(t, cmd.Status.Output, "stub hello")
+
+	cmd = NewCommand("env echo hello", WithPathPrepend(dir))
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, "stub hello")
+
+	// the inherited PATH is kept
+	cmd = NewCommand("ls -d /", WithExecMode(true), WithPathPrepend(dir))
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, "/\n")
+
+	cmd = NewCommand("echo hello", WithExecMode(true))
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, "hello\n")
+}
+
+func TestWithEnvMap(t *testing.T) {
+	os.Setenv("GO_SHELL_ENV_MAP", "parent")
+	defer os.Unsetenv("GO_SHELL_ENV_MAP")
+
+	m := map[string]string{"GO_SHELL_ENV_MAP": "map", "B_KEY": "b", "A_KEY": "a"}
+	cmd := NewCommand("echo -n $GO_SHELL_ENV_MAP $A_KEY", WithEnvMap(m, true))
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, "map a")
+	assert.Equal(t, cmd.Env[len(cmd.Env)-3:], []string{"A_KEY=a", "B_KEY=b", "GO_SHELL_ENV_MAP=map"})
+
+	cmd = NewCommand("echo -n \"$HOME\" $B_KEY", WithEnvMap(m, false))
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, " b")
+	assert.Equal(t, cmd.Env, []string{"A_KEY=a", "B_KEY=b", "GO_SHELL_ENV_MAP=map"})
+}
+
+func TestWithCaptureEnv(t *testing.T) {
+	cmd := NewCommand("true", WithEnvMap(map[string]string{"APP_NAME": "xiaorui", "DB_PASS": "secret", "API_TOKEN": "secret"}, true),
+		WithRedactEnv("DB_PASS"), WithCaptureEnv())
+	cmd.Run()
+	assert.Contains(t, cmd.Status.Env, "APP_NAME=xiaorui")
+	assert.Contains(t, cmd.Status.Env, "DB_PASS=***")
+	assert.Contains(t, cmd.Status.Env, "API_TOKEN=***")
+	assert.Contains(t, cmd.Status.Env, "PATH="+os.Getenv("PATH"))
+
+	// the parent env is captured when the env isn't set
+	cmd = NewCommand("true", WithCaptureEnv())
+	cmd.Run()
+	assert.Equal(t, len(cmd.Status.Env), len(os.Environ()))
+
+	cmd = NewCommand("true")
+	cmd.Run()
+	assert.Nil(t, cmd.Status.Env)
+}
@@ -0,0 +1,77 @@
+package shell
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// the stderr in CmdError is truncated to the last bytes
+const cmdErrorStderrLimit = 512
+
+// CmdError command failure with the context of what ran, Err is the original error, see Status.CmdError.
+type CmdError struct {
+	Name     string // set by WithName
+	Command  string
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func newCmdError(command string, exitCode int, stderr string, err error) *CmdError {
+	return &CmdError{
+		Command:  command,
+		ExitCode: exitCode,
+		Stderr:   tailString(stderr, cmdErrorStderrLimit),
+		Err:      err,
+	}
+}
+
+// tailString keep the last limit bytes of s, "..." is prefixed when it's truncated
+func tailString(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	return "..." + s[len(s)-limit:]
+}
+
+func (e *CmdError) Error() string {
+	msg := fmt.Sprintf("command %q failed, exit code: %d, err: %v", e.Command, e.ExitCode, e.Err)
+	if e.Name != "" {
+		msg = fmt.Sprintf("command %s %q failed, exit code: %d, err: %v", e.Name, e.Command, e.ExitCode, e.Err)
+	}
+	if e.Stderr != "" {
+		msg += fmt.Sprintf(", stderr: %q", e.Stderr)
+	}
+	return msg
+}
+
+// Unwrap return the original error, errors.Is and errors.As work through it.
+func (e *CmdError) Unwrap() error {
+	return e.Err
+}
+
+// IsCommandNotFound the command is not found, exit code 127
+func IsCommandNotFound(err error) bool {
+	return errors.Is(err, ErrNotFoundCommand)
+}
+
+// IsPermissionDenied the command is not executable, exit code 126
+func IsPermissionDenied(err error) bool {
+	return errors.Is(err, ErrNotExecutePermission)
+}
+
+// IsTimeout the command is killed by the timeout or the idle timeout
+func IsTimeout(err error) bool {
+	return errors.Is(err, ErrProcessTimeout) || errors.Is(err, ErrIdleTimeout)
+}
+
+// IsCanceled the command is canceled
+func IsCanceled(err error) bool {
+	return errors.Is(err, ErrProcessCancel)
+}
+
+// IsOOMKilled the command is killed by the oom killer, it's best-effort and linux only, see WithOOMDetection
+func IsOOMKilled(err error) bool {
+	return errors.Is(err, ErrOOMKilled)
+}
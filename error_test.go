@@ -0,0 +1,151 @@
+package shell
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCmdError(t *testing.T) {
+	cmd := NewCommand("echo failed-reason >&2; exit 3")
+	cmd.Run()
+	err := error(cmd.Status.CmdError)
+
+	assert.Contains(t, err.Error(), "echo failed-reason >&2; exit 3")
+	assert.Contains(t, err.Error(), "exit code: 3")
+	assert.Contains(t, err.Error(), "failed-reason")
+
+	var cmdErr *CmdError
+	assert.True(t, errors.As(err, &cmdErr))
+	assert.Equal(t, cmdErr.ExitCode, 3)
+	assert.Equal(t, cmdErr.Stderr, "failed-reason\n")
+	assert.True(t, errors.Is(err, cmd.Status.Error))
+
+	// Status.Error keeps the sentinel error
+	cmd = NewCommand("xiaorui.cc")
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Error, ErrNotFoundCommand)
+	assert.True(t, errors.Is(cmd.Status.CmdError, ErrNotFoundCommand))
+	assert.Equal(t, cmd.Status.CmdError.ExitCode, 127)
+
+	cmd = NewCommand("exit 0")
+	cmd.Run()
+	assert.Nil(t, cmd.Status.CmdError)
+}
+
+func TestWithName(t *testing.T) {
+	buf := &bytes.Buffer{}
+	cmd := NewCommand("exit 3", WithName("backup"), WithLogger(log.New(buf, "", 0)))
+	cmd.Run()
+
+	assert.Contains(t, cmd.Status.CmdError.Error(), `command backup "exit 3" failed`)
+	assert.Equal(t, cmd.Status.CmdError.Name, "backup")
+	assert.Contains(t, buf.String(), "[backup] starting command")
+}
+
+func TestStartError(t *testing.T) {
+	cmd := NewCommand("not-exist-binary-xx -v", WithExecMode(true))
+	err := cmd.Start()
+	assert.True(t, IsCommandNotFound(err))
+	assert.True(t, IsCommandNotFound(cmd.Status.Error))
+	assert.Contains(t, err.Error(), "not-exist-binary-xx")
+
+	cmd = NewCommand("/not-exist-dir/binary", WithExecMode(true))
+	assert.True(t, IsCommandNotFound(cmd.Run()))
+
+	file, err := ioutil.TempFile("", "go-shell-noexec")
+	assert.Nil(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+	cmd = NewCommand(file.Name(), WithExecMode(true))
+	assert.True(t, IsPermissionDenied(cmd.Run()))
+
+	cmd = NewCommand("ls", WithExecMode(true), WithSetDir("/not-exist-dir"))
+	err = cmd.Run()
+	assert.NotNil(t, err)
+	assert.False(t, IsCommandNotFound(err))
+}
+
+func TestCmdErrorTruncateStderr(t *testing.T) {
+	err := newCmdError("ls", 1, strings.Repeat("a", 1000)+"end", errors.New("exit status 1"))
+	assert.Equal(t, len(err.Stderr), cmdErrorStderrLimit+3)
+	assert.True(t, strings.HasPrefix(err.Stderr, "..."))
+	assert.True(t, strings.HasSuffix(err.Stderr, "end"))
+}
+
+func TestWithStderrTail(t *testing.T) {
+	script := "for i in $(seq 1 1000); do echo error line $i >&2; done; echo last >&2; exit 1"
+	cmd := NewCommand(script, WithStderrTail(64))
+	cmd.Run()
+
+	cmdErr := cmd.Status.CmdError
+	assert.Equal(t, len(cmdErr.Stderr), 64+3)
+	assert.True(t, strings.HasPrefix(cmdErr.Stderr, "..."))
+	assert.True(t, strings.HasSuffix(cmdErr.Stderr, "last\n"))
+	assert.NotContains(t, cmdErr.Error(), "error line 990")
+	assert.Contains(t, cmd.Status.Stderr, "error line 1\n")
+
+	// more than the default
+	cmd = NewCommand(script, WithStderrTail(4096))
+	cmd.Run()
+	assert.Equal(t, len(cmd.Status.CmdError.Stderr), 4096+3)
+}
+
+func TestErrorPredicates(t *testing.T) {
+	cases := []struct {
+		err  error
+		pred func(error) bool
+	}{
+		{ErrNotFoundCommand, IsCommandNotFound},
+		{ErrNotExecutePermission, IsPermissionDenied},
+		{ErrProcessTimeout, IsTimeout},
+		{ErrIdleTimeout, IsTimeout},
+		{ErrProcessCancel, IsCanceled},
+		{ErrOOMKilled, IsOOMKilled},
+	}
+
+	for _, c := range cases {
+		assert.True(t, c.pred(c.err))
+		assert.True(t, c.pred(fmt.Errorf("wrapped: %w", c.err)))
+		assert.True(t, c.pred(newCmdError("ls", 1, "", c.err)))
+		assert.False(t, c.pred(errors.New("other")))
+		assert.False(t, c.pred(nil))
+	}
+
+	cmd := NewCommand("xiaorui.cc")
+	cmd.Run()
+	assert.True(t, IsCommandNotFound(cmd.Status.Error))
+	assert.False(t, IsTimeout(cmd.Status.Error))
+}
+
+func TestWithExitCodeErrors(t *testing.T) {
+	errConflict := errors.New("conflict")
+	cmd := NewCommand("exit 3", WithExitCodeErrors(map[int]error{3: errConflict, 127: errConflict}))
+	cmd.Run()
+	assert.True(t, errors.Is(cmd.Status.Error, errConflict))
+	assert.Equal(t, cmd.Status.ExitCode, 3)
+
+	cmd = NewCommand("xiaorui.cc", WithExitCodeErrors(map[int]error{127: errConflict}))
+	cmd.Run()
+	assert.True(t, errors.Is(cmd.Status.Error, errConflict))
+	assert.False(t, IsCommandNotFound(cmd.Status.Error))
+
+	// the other command keeps the raw error
+	cmd = NewCommand("exit 3")
+	cmd.Run()
+	assert.False(t, errors.Is(cmd.Status.Error, errConflict))
+	var exitErr *exec.ExitError
+	assert.True(t, errors.As(cmd.Status.Error, &exitErr))
+
+	cmd = NewCommand("exit 4", WithExitCodeErrors(map[int]error{3: errConflict}))
+	cmd.Run()
+	assert.True(t, errors.As(cmd.Status.Error, &exitErr))
+}
@@ -0,0 +1,159 @@
+package shell
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type EventType int
+
+const (
+	EventStdout EventType = iota
+	EventStderr
+	EventExit
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventStdout:
+		return "stdout"
+	case EventStderr:
+		return "stderr"
+	case EventExit:
+		return "exit"
+	}
+	return "unknown"
+}
+
+// Event stream event, Line is set for stdout and stderr, Status is set for exit.
+type Event struct {
+	Type   EventType
+	Line   string
+	Status Status
+}
+
+// Events return the stream of stdout lines, stderr lines and the final exit event,
+// the channel is closed after the exit event. must be called before Start, the
+// command is blocked when the events are not consumed.
+func (c *Cmd) Events() <-chan Event {
+	if c.events != nil {
+		return c.events
+	}
+
+	c.events = make(chan Event, 128)
+	send := func(typ EventType) func(string) {
+		return func(line string) {
+			c.events <- Event{Type: typ, Line: line}
+		}
+	}
+
+	stdout := newLineWriter(send(EventStdout))
+	stderr := newLineWriter(send(EventStderr))
+	c.stdoutWriters = append(c.stdoutWriters, stdout)
+	c.stderrWriters = append(c.stderrWriters, stderr)
+
+	// the exit hooks run again when Start is called after a start failure
+	var once sync.Once
+	c.exitHooks = append(c.exitHooks, func(status Status) {
+		once.Do(func() {
+			stdout.Flush()
+			stderr.Flush()
+			c.events <- Event{Type: EventExit, Status: status}
+			close(c.events)
+		})
+	})
+	return c.events
+}
+
+// StreamLine labeled output line
+type StreamLine struct {
+	Stderr bool
+	Text   string
+}
+
+// WithLabeledStream send stdout and stderr lines to ch labeled with the source, ch is closed after exit.
+// the order across stdout and stderr is best-effort, the two pipes are read concurrently.
+func WithLabeledStream(ch chan StreamLine) optionFunc {
+	return func(o *Cmd) error {
+		var mu sync.Mutex
+		send := func(stderr bool) func(string) {
+			return func(line string) {
+				mu.Lock()
+				defer mu.Unlock()
+				ch <- StreamLine{Stderr: stderr, Text: line}
+			}
+		}
+
+		stdout := newLineWriter(send(false))
+		stderr := newLineWriter(send(true))
+		o.stdoutWriters = append(o.stdoutWriters, stdout)
+		o.stderrWriters = append(o.stderrWriters, stderr)
+
+		// the exit hooks run again when Start is called after a start failure
+		var once sync.Once
+		o.exitHooks = append(o.exitHooks, func(Status) {
+			once.Do(func() {
+				stdout.Flush()
+				stderr.Flush()
+				close(ch)
+			})
+		})
+		return nil
+	}
+}
+
+// WithLineCallback call fn with every stdout and stderr line. a panic in fn is recovered and recorded
+// in Status.CallbackError, the output is still drained and the command finishes normally.
+func WithLineCallback(fn func(line string)) optionFunc {
+	return func(o *Cmd) error {
+		var mu sync.Mutex
+		call := func(line string) {
+			mu.Lock()
+			defer mu.Unlock()
+			defer func() {
+				if r := recover(); r != nil {
+					o.recordCallbackPanic(r)
+				}
+			}()
+			fn(line)
+		}
+
+		stdout := newLineWriter(call)
+		stderr := newLineWriter(call)
+		o.stdoutWriters = append(o.stdoutWriters, stdout)
+		o.stderrWriters = append(o.stderrWriters, stderr)
+		o.exitHooks = append(o.exitHooks, func(Status) {
+			stdout.Flush()
+			stderr.Flush()
+		})
+		return nil
+	}
+}
+
+// WithOnComplete call fn once with the final status after the command exits and the output is drained,
+// the fire-and-forget usage doesn't need a goroutine to Wait. it's called after the last attempt of WithRetry,
+// and with the start error when the command fails to start, the later Start or Restart doesn't call it again.
+func WithOnComplete(fn func(Status)) optionFunc {
+	return func(o *Cmd) error {
+		// the exit hooks run again when Start is called after a start failure
+		var once sync.Once
+		o.exitHooks = append(o.exitHooks, func(status Status) {
+			once.Do(func() {
+				fn(status)
+			})
+		})
+		return nil
+	}
+}
+
+// recordCallbackPanic keep the first panic of the callbacks
+func (c *Cmd) recordCallbackPanic(r interface{}) {
+	c.logf("line callback panic: %v", r)
+
+	c.Lock()
+	defer c.Unlock()
+	if c.Status.CallbackError == nil {
+		c.Status.CallbackError = errors.Errorf("line callback panic: %v", r)
+	}
+}
@@ -0,0 +1,129 @@
+package shell
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvents(t *testing.T) {
+	cmd := NewCommand("echo a; echo b >&2; exit 3")
+	events := cmd.Events()
+	cmd.Start()
+
+	var stdout, stderr []string
+	var last Event
+	for ev := range events {
+		switch ev.Type {
+		case EventStdout:
+			stdout = append(stdout, ev.Line)
+		case EventStderr:
+			stderr = append(stderr, ev.Line)
+		}
+		last = ev
+	}
+
+	assert.Equal(t, stdout, []string{"a"})
+	assert.Equal(t, stderr, []string{"b"})
+	assert.Equal(t, last.Type, EventExit)
+	assert.Equal(t, last.Status.ExitCode, 3)
+	assert.Equal(t, last.Status.Finish, true)
+
+	// the channel is closed once when Start is called again after a start failure
+	cmd = NewCommand("echo a", WithStdinFile("/not-exist-dir/stdin"))
+	events = cmd.Events()
+	assert.NotNil(t, cmd.Start())
+	assert.NotPanics(t, func() {
+		assert.NotNil(t, cmd.Start())
+	})
+	ev := <-events
+	assert.Equal(t, ev.Type, EventExit)
+	assert.NotNil(t, ev.Status.Error)
+	_, ok := <-events
+	assert.False(t, ok)
+}
+
+func TestWithLabeledStream(t *testing.T) {
+	ch := make(chan StreamLine, 10)
+	cmd := NewCommand("echo out; echo err >&2", WithLabeledStream(ch))
+	cmd.Start()
+
+	var lines []StreamLine
+	for line := range ch {
+		lines = append(lines, line)
+	}
+	cmd.Wait()
+
+	assert.Equal(t, len(lines), 2)
+	assert.Contains(t, lines, StreamLine{Stderr: false, Text: "out"})
+	assert.Contains(t, lines, StreamLine{Stderr: true, Text: "err"})
+
+	// ch is closed once when Start is called again after a start failure
+	ch = make(chan StreamLine, 10)
+	cmd = NewCommand("echo out", WithLabeledStream(ch), WithStdinFile("/not-exist-dir/stdin"))
+	assert.NotNil(t, cmd.Start())
+	assert.NotPanics(t, func() {
+		assert.NotNil(t, cmd.Start())
+	})
+	_, ok := <-ch
+	assert.False(t, ok)
+}
+
+func TestWithLineCallbackPanic(t *testing.T) {
+	var lines []string
+	callback := func(line string) {
+		lines = append(lines, line)
+		if len(lines) == 2 {
+			panic("bad line " + line)
+		}
+	}
+
+	cmd := NewCommand("echo 1; echo 2; echo 3; echo -n 4", WithLineCallback(callback))
+	err := cmd.Run()
+	<-cmd.exited
+
+	assert.Nil(t, err)
+	assert.Equal(t, cmd.Status.Finish, true)
+	assert.Equal(t, cmd.Status.Output, "1\n2\n3\n4")
+	assert.Equal(t, lines, []string{"1", "2", "3", "4"})
+	assert.NotNil(t, cmd.Status.CallbackError)
+	assert.Contains(t, cmd.Status.CallbackError.Error(), "bad line 2")
+}
+
+func TestWithOnComplete(t *testing.T) {
+	var calls int32
+	done := make(chan Status, 2)
+	cmd := NewCommand("echo out; exit 3", WithOnComplete(func(s Status) {
+		atomic.AddInt32(&calls, 1)
+		done <- s
+	}))
+	assert.Nil(t, cmd.Start())
+
+	status := <-done
+	assert.Equal(t, status.ExitCode, 3)
+	assert.Equal(t, status.Output, "out\n")
+	assert.Equal(t, status.Finish, true)
+
+	// once after the retry attempts
+	cmd = NewCommand("exit 1", WithRetry(3, 0), WithOnComplete(func(s Status) {
+		atomic.AddInt32(&calls, 1)
+		done <- s
+	}))
+	cmd.Run()
+	status = <-done
+	assert.Equal(t, status.Attempts, 3)
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(2))
+
+	// once when Start is called again after the start failure
+	calls = 0
+	cmd = NewCommand("cat", WithStdinFile("/not-exist-dir/stdin"), WithOnComplete(func(s Status) {
+		atomic.AddInt32(&calls, 1)
+		done <- s
+	}))
+	assert.NotNil(t, cmd.Start())
+	assert.NotNil(t, cmd.Start())
+	status = <-done
+	assert.Contains(t, status.Error.Error(), "open stdin file failed")
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(1))
+}
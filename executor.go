@@ -0,0 +1,13 @@
+package shell
+
+// Executor run a shell command, return CombinedOutput, exitcode, err, the same as Command.
+type Executor interface {
+	Command(args string) (string, int, error)
+}
+
+// LocalExecutor run the command on the local host
+type LocalExecutor struct{}
+
+func (LocalExecutor) Command(args string) (string, int, error) {
+	return Command(args)
+}
@@ -0,0 +1,44 @@
+package shell
+
+// Future async handle of a started command
+type Future struct {
+	cmd    *Cmd
+	done   chan struct{}
+	status Status
+}
+
+// Future start the command if it isn't started, return the handle of the completion.
+// usage: f1, f2 := NewCommand("ls").Future(), NewCommand("df").Future(); f1.Await(); f2.Await()
+func (c *Cmd) Future() *Future {
+	f := &Future{
+		cmd:  c,
+		done: make(chan struct{}),
+	}
+
+	if cmd, _ := c.started(); cmd == nil {
+		if err := c.Start(); err != nil {
+			c.Lock()
+			f.status = c.Status
+			c.Unlock()
+			close(f.done)
+			return f
+		}
+	}
+
+	go func() {
+		f.status = c.WaitStatus()
+		close(f.done)
+	}()
+	return f
+}
+
+// Done closed when the command finished
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Await wait the command finish, return the final status
+func (f *Future) Await() Status {
+	<-f.done
+	return f.status
+}
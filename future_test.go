@@ -0,0 +1,49 @@
+package shell
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuture(t *testing.T) {
+	start := time.Now()
+	futures := make([]*Future, 0, 5)
+	for i := 0; i < 5; i++ {
+		futures = append(futures, NewCommand(fmt.Sprintf("sleep 0.5; echo -n %d; exit %d", i, i)).Future())
+	}
+
+	for i, f := range futures {
+		status := f.Await()
+		assert.Equal(t, status.Finish, true)
+		assert.Equal(t, status.ExitCode, i)
+		assert.Equal(t, status.Output, fmt.Sprint(i))
+
+		select {
+		case <-f.Done():
+		default:
+			t.Fatal("done is not closed after await")
+		}
+	}
+
+	// run concurrently
+	assert.Less(t, time.Since(start).Seconds(), float64(2))
+}
+
+func TestFutureStartError(t *testing.T) {
+	f := NewCommand("xiaorui.cc", WithExecMode(true)).Future()
+	status := f.Await()
+	assert.NotNil(t, status.Error)
+}
+
+func TestFutureStarted(t *testing.T) {
+	cmd := NewCommand("sleep 0.2; echo -n ok")
+	assert.Nil(t, cmd.Start())
+
+	// not started again
+	status := cmd.Future().Await()
+	assert.Nil(t, status.Error)
+	assert.Equal(t, status.Output, "ok")
+}
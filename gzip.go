@@ -0,0 +1,87 @@
+package shell
+
+import (
+	"compress/gzip"
+	"os"
+	"sync"
+)
+
+// gzipFileWriter compress the writes into a file, it's shared by the stdout and stderr copy goroutines.
+type gzipFileWriter struct {
+	sync.Mutex
+
+	path   string
+	file   *os.File
+	gz     *gzip.Writer
+	closed bool // the gzip member is closed by Flush, the next write starts a new member
+}
+
+func newGzipFileWriter(path string) *gzipFileWriter {
+	return &gzipFileWriter{path: path}
+}
+
+// open truncate the file if it's closed, WithCompressedOutputFile opens it on start
+func (w *gzipFileWriter) open() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file != nil {
+		return nil
+	}
+
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.gz = gzip.NewWriter(file)
+	w.closed = false
+	return nil
+}
+
+func (w *gzipFileWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if w.closed {
+		w.gz.Reset(w.file)
+		w.closed = false
+	}
+	return w.gz.Write(p)
+}
+
+// Flush complete the gzip member with the footer after the process exit, the file is readable before Close.
+// the members of the retry attempts are concatenated, gzip readers read them as one stream.
+func (w *gzipFileWriter) Flush() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file == nil || w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.gz.Close()
+}
+
+// Close flush the compressed data and the gzip footer, then close the file
+func (w *gzipFileWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	var err error
+	if !w.closed {
+		err = w.gz.Close()
+	}
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+	return err
+}
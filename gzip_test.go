@@ -0,0 +1,59 @@
+package shell
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithCompressedOutputFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-shell-gzip")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fpath := dir + "/output.log.gz"
+	cmd, err := NewCommandE("for i in $(seq 1 100); do echo line $i; done; echo error >&2", WithCompressedOutputFile(fpath))
+	assert.Nil(t, err)
+	cmd.Run()
+	assert.Nil(t, cmd.Status.Error)
+
+	file, err := os.Open(fpath)
+	assert.Nil(t, err)
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(gz)
+	assert.Nil(t, err)
+	assert.Equal(t, string(content), cmd.Status.Output)
+	assert.Contains(t, string(content), "line 100\n")
+
+	// the attempts are appended as the gzip members
+	fpath = dir + "/retry.log.gz"
+	cmd, err = NewCommandE("echo retry; exit 1", WithCompressedOutputFile(fpath), WithRetry(2, 0))
+	assert.Nil(t, err)
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Attempts, 2)
+
+	file, err = os.Open(fpath)
+	assert.Nil(t, err)
+	defer file.Close()
+	gz, err = gzip.NewReader(file)
+	assert.Nil(t, err)
+	content, err = ioutil.ReadAll(gz)
+	assert.Nil(t, err)
+	assert.Equal(t, string(content), "retry\nretry\n")
+
+	// the file is opened on Start, not when the command is built
+	fpath = dir + "/not-started.log.gz"
+	NewCommand("echo 123", WithCompressedOutputFile(fpath))
+	_, err = os.Stat(fpath)
+	assert.True(t, os.IsNotExist(err))
+
+	cmd = NewCommand("echo 123", WithCompressedOutputFile("/not-exist-dir/output.log.gz"))
+	err = cmd.Start()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "open output file failed")
+}
@@ -0,0 +1,81 @@
+//go:build go1.18
+// +build go1.18
+
+package shell
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"syscall"
+)
+
+// CommandJSONLines decode every stdout line of the command as json into T and send it to out, example: `docker events
+// --format '{{json .}}'`. the malformed lines are skipped, out is closed when the command exits. the sends block
+// until consumed, the process group is killed when ctx is done.
+func CommandJSONLines[T any](ctx context.Context, args string, out chan<- T) error {
+	return CommandJSONLinesFunc(ctx, args, out, nil)
+}
+
+// CommandJSONLinesFunc like CommandJSONLines, call onError with the malformed line and the decode error
+func CommandJSONLinesFunc[T any](ctx context.Context, args string, out chan<- T, onError func(line string, err error)) error {
+	defer close(out)
+
+	runner := exec.Command("bash", "-c", args)
+	runner.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := runner.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = runner.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-runner.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 4096), 16<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var v T
+		if err := json.Unmarshal(line, &v); err != nil {
+			if onError != nil {
+				onError(string(line), err)
+			}
+			continue
+		}
+
+		select {
+		case out <- v:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	io.Copy(ioutil.Discard, stdout) // the rest after a too long line, don't block the writer of the pipe
+
+	err = runner.Wait()
+	if ctx.Err() != nil {
+		return contextError(ctx)
+	}
+	return formatExitCode(err)
+}
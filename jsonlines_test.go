@@ -0,0 +1,42 @@
+//go:build go1.18
+// +build go1.18
+
+package shell
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type jsonEvent struct {
+	Type string `json:"type"`
+	ID   int    `json:"id"`
+}
+
+func TestCommandJSONLines(t *testing.T) {
+	out := make(chan jsonEvent, 10)
+	var malformed []string
+	script := `echo '{"type":"start","id":1}'; echo 'not json'; echo; echo '{"type":"stop","id":2}'`
+	err := CommandJSONLinesFunc(context.Background(), script, out, func(line string, err error) {
+		malformed = append(malformed, line)
+	})
+	assert.Nil(t, err)
+
+	var events []jsonEvent
+	for ev := range out {
+		events = append(events, ev)
+	}
+	assert.Equal(t, events, []jsonEvent{{"start", 1}, {"stop", 2}})
+	assert.Equal(t, malformed, []string{"not json"})
+
+	// the consumer is gone, ctx releases the command
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = CommandJSONLines(ctx, `while true; do echo '{"type":"loop"}'; sleep 0.01; done`, make(chan jsonEvent))
+	assert.Equal(t, err, ErrProcessTimeout)
+	assert.Less(t, time.Since(start).Seconds(), float64(1))
+}
@@ -0,0 +1,96 @@
+package shell
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var ErrConcurrencyLimit = errors.New("max concurrency of commands reached")
+
+// limiter package-level semaphore of the running commands
+var limiter struct {
+	sync.Mutex
+	sem      chan struct{}
+	failFast bool
+}
+
+// SetMaxConcurrency limit the running commands of the package to n, Start blocks when the limit is reached.
+// n <= 0 is unlimited, the default. the running commands aren't affected by the change.
+func SetMaxConcurrency(n int) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	if n <= 0 {
+		limiter.sem = nil
+		return
+	}
+	limiter.sem = make(chan struct{}, n)
+}
+
+// SetConcurrencyFailFast Start returns ErrConcurrencyLimit instead of blocking when the limit is reached
+func SetConcurrencyFailFast(b bool) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	limiter.failFast = b
+}
+
+// WithConcurrencyToken call acquire before the command starts and the returned release after it exits,
+// the command joins the concurrency budget of the app, example: a semaphore.Weighted or a token channel.
+// Start returns the acquire error, release is called once even when the start fails.
+func WithConcurrencyToken(acquire func() (release func(), err error)) optionFunc {
+	return func(o *Cmd) error {
+		o.tokenAcquire = acquire
+		return nil
+	}
+}
+
+// acquire take a slot of the max concurrency, the slot is released with the exit hooks
+func (c *Cmd) acquire() error {
+	limiter.Lock()
+	sem, failFast := limiter.sem, limiter.failFast
+	limiter.Unlock()
+
+	if sem == nil {
+		return c.acquireToken()
+	}
+
+	if failFast {
+		select {
+		case sem <- struct{}{}:
+		default:
+			return ErrConcurrencyLimit
+		}
+	} else {
+		sem <- struct{}{}
+	}
+
+	c.release = func() { <-sem }
+	return c.acquireToken()
+}
+
+// acquireToken take the token of WithConcurrencyToken after the slot, the slot is released on failure
+func (c *Cmd) acquireToken() error {
+	if c.tokenAcquire == nil {
+		return nil
+	}
+
+	release, err := c.tokenAcquire()
+	if err != nil {
+		c.releaseSlot()
+		return err
+	}
+	c.tokenRelease = release
+	return nil
+}
+
+func (c *Cmd) releaseSlot() {
+	if c.tokenRelease != nil {
+		c.tokenRelease()
+		c.tokenRelease = nil
+	}
+	if c.release != nil {
+		c.release()
+		c.release = nil
+	}
+}
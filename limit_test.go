@@ -0,0 +1,106 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetMaxConcurrency(t *testing.T) {
+	SetMaxConcurrency(2)
+	defer SetMaxConcurrency(0)
+
+	dir, err := ioutil.TempDir("", "go-shell-limit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	running, logFile := filepath.Join(dir, "running"), filepath.Join(dir, "log")
+	os.Mkdir(running, 0755)
+
+	// record the running count at the start of every command
+	script := fmt.Sprintf("touch %[1]s/$$; ls %[1]s | wc -l >> %[2]s; sleep 0.3; rm %[1]s/$$", running, logFile)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			NewCommand(script).Run()
+		}()
+	}
+	wg.Wait()
+
+	bs, err := ioutil.ReadFile(logFile)
+	assert.Nil(t, err)
+	counts := strings.Fields(string(bs))
+	assert.Equal(t, len(counts), 5)
+	for _, count := range counts {
+		n, _ := strconv.Atoi(count)
+		assert.LessOrEqual(t, n, 2)
+	}
+}
+
+func TestSetConcurrencyFailFast(t *testing.T) {
+	SetMaxConcurrency(1)
+	SetConcurrencyFailFast(true)
+	defer func() {
+		SetMaxConcurrency(0)
+		SetConcurrencyFailFast(false)
+	}()
+
+	cmd := NewCommand("sleep 0.3")
+	assert.Nil(t, cmd.Start())
+
+	err := NewCommand("echo 1").Start()
+	assert.Equal(t, err, ErrConcurrencyLimit)
+
+	cmd.Wait()
+	<-cmd.exited // the slot is released after the exit hooks
+	assert.Nil(t, NewCommand("echo 1").Run())
+}
+
+func TestWithConcurrencyToken(t *testing.T) {
+	var acquired, released int64
+	token := WithConcurrencyToken(func() (func(), error) {
+		atomic.AddInt64(&acquired, 1)
+		return func() { atomic.AddInt64(&released, 1) }, nil
+	})
+
+	var wg sync.WaitGroup
+	for _, script := range []string{"echo ok", "exit 3", "not-exist-command-xx", "sleep 5"} {
+		wg.Add(1)
+		go func(script string) {
+			defer wg.Done()
+			cmd := NewCommand(script, token, WithTimeout(1))
+			cmd.Run()
+			<-cmd.exited // the token is released after the exit hooks, Stop releases Wait before
+		}(script)
+	}
+	wg.Wait()
+
+	// the start failure releases the token too
+	cmd := NewCommand("echo ok", token, WithStdinFile("/not-exist-dir/stdin"))
+	assert.NotNil(t, cmd.Start())
+	cmd = NewCommand("exit 1", token, WithRetry(3, 0))
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Attempts, 3)
+
+	assert.Equal(t, atomic.LoadInt64(&acquired), int64(8))
+	assert.Equal(t, atomic.LoadInt64(&released), atomic.LoadInt64(&acquired))
+
+	// the acquire error fails the start
+	errBudget := errors.New("no budget")
+	cmd = NewCommand("echo ok", WithConcurrencyToken(func() (func(), error) {
+		return nil, errBudget
+	}))
+	assert.Equal(t, cmd.Start(), errBudget)
+	assert.Equal(t, cmd.Status.Error, errBudget)
+}
@@ -0,0 +1,76 @@
+package shell
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrLockTimeout = errors.New("acquire lock file timeout")
+
+const lockPollInterval = 50 * time.Millisecond
+
+// WithLockFile hold an advisory flock on path while the command runs, the commands with the same
+// lock file don't overlap across processes. Start blocks when the lock is held, see WithLockFileTimeout.
+func WithLockFile(path string) optionFunc {
+	return func(o *Cmd) error {
+		o.lockPath = path
+		return nil
+	}
+}
+
+// WithLockFileTimeout Start returns ErrLockTimeout when the lock file isn't acquired in d, default wait forever
+func WithLockFileTimeout(d time.Duration) optionFunc {
+	return func(o *Cmd) error {
+		o.lockTimeout = d
+		return nil
+	}
+}
+
+// lock acquire the lock file, it's released with the exit hooks
+func (c *Cmd) lock() error {
+	file, err := os.OpenFile(c.lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Errorf("open lock file failed, err: %s", err.Error())
+	}
+
+	if c.lockTimeout <= 0 {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	} else {
+		err = flockTimeout(file, c.lockTimeout)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	c.logf("acquired lock file: %s", c.lockPath)
+	c.lockFile = file
+	return nil
+}
+
+func flockTimeout(file *os.File, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return ErrLockTimeout
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+func (c *Cmd) unlock() {
+	if c.lockFile == nil {
+		return
+	}
+
+	syscall.Flock(int(c.lockFile.Fd()), syscall.LOCK_UN)
+	c.lockFile.Close()
+	c.lockFile = nil
+}
@@ -0,0 +1,50 @@
+package shell
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-shell-lock")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	lockPath, logFile := filepath.Join(dir, "lock"), filepath.Join(dir, "log")
+
+	script := fmt.Sprintf("echo start >> %[1]s; sleep 0.3; echo end >> %[1]s", logFile)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			NewCommand(script, WithLockFile(lockPath)).Run()
+		}()
+	}
+	wg.Wait()
+
+	bs, err := ioutil.ReadFile(logFile)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Fields(string(bs)), []string{"start", "end", "start", "end"})
+}
+
+func TestWithLockFileTimeout(t *testing.T) {
+	lockPath := filepath.Join(os.TempDir(), "go-shell-lock-"+randString(8))
+	defer os.Remove(lockPath)
+
+	cmd := NewCommand("sleep 1", WithLockFile(lockPath))
+	assert.Nil(t, cmd.Start())
+	defer cmd.Stop()
+
+	start := time.Now()
+	err := NewCommand("echo 1", WithLockFile(lockPath), WithLockFileTimeout(200*time.Millisecond)).Start()
+	assert.Equal(t, err, ErrLockTimeout)
+	assert.Less(t, time.Since(start).Seconds(), float64(1))
+}
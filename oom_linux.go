@@ -0,0 +1,31 @@
+package shell
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// oomKillCount read the oom_kill counter of /proc/vmstat, the memory cgroup oom kills are counted too.
+// return -1 when it isn't supported, the kernel before 4.13.
+func oomKillCount() int64 {
+	file, err := os.Open("/proc/vmstat")
+	if err != nil {
+		return -1
+	}
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return -1
+			}
+			return n
+		}
+	}
+	return -1
+}
@@ -0,0 +1,44 @@
+package shell
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOOMKilled(t *testing.T) {
+	if oomKillCount() < 0 {
+		t.Skip("oom_kill of /proc/vmstat isn't supported")
+	}
+
+	// cgroup v1 memory controller, it needs root
+	cgroup := fmt.Sprintf("/sys/fs/cgroup/memory/go-shell-oom-%s", randString(8))
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		t.Skipf("create memory cgroup failed, err: %v", err)
+	}
+	defer os.Remove(cgroup)
+	if err := ioutil.WriteFile(cgroup+"/memory.limit_in_bytes", []byte("33554432"), 0644); err != nil {
+		t.Skipf("set memory limit failed, err: %v", err)
+	}
+	ioutil.WriteFile(cgroup+"/memory.memsw.limit_in_bytes", []byte("33554432"), 0644)
+
+	// tail buffers the endless line of /dev/zero in memory
+	script := fmt.Sprintf("echo $$ > %s/cgroup.procs && exec tail /dev/zero", cgroup)
+	cmd := NewCommand(script, WithOOMDetection())
+	cmd.Run()
+	assert.True(t, IsOOMKilled(cmd.Status.Error))
+	assert.Equal(t, cmd.Status.ExitCode, -1)
+
+	// the SIGKILL sent by Stop isn't oom
+	cmd = NewCommand("sleep 5", WithTimeout(1), WithOOMDetection())
+	cmd.Run()
+	assert.False(t, IsOOMKilled(cmd.Status.Error))
+
+	// not detected without the option
+	cmd = NewCommand(script)
+	cmd.Run()
+	assert.False(t, IsOOMKilled(cmd.Status.Error))
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package shell
+
+// oomKillCount is only supported on linux
+func oomKillCount() int64 {
+	return -1
+}
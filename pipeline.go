@@ -0,0 +1,128 @@
+package shell
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Pipeline run the stages like `stage0 | stage1 | ...`, every stage is started with `bash -c`.
+type Pipeline struct {
+	stages []string
+	cmds   []*exec.Cmd
+
+	output bytes.Buffer // stdout of the last stage
+	stderr syncBuffer   // stderr of all stages
+}
+
+func NewPipeline(stages ...string) *Pipeline {
+	return &Pipeline{
+		stages: stages,
+	}
+}
+
+// Start async execute all stages
+func (p *Pipeline) Start() error {
+	if len(p.stages) == 0 {
+		return errors.New("empty pipeline")
+	}
+	if p.cmds != nil {
+		return ErrAlreadyFinished
+	}
+
+	var pipes []*os.File
+	defer func() {
+		// the children own the pipe fds after start
+		for _, f := range pipes {
+			f.Close()
+		}
+	}()
+
+	cmds := make([]*exec.Cmd, 0, len(p.stages))
+	for _, stage := range p.stages {
+		cmd := exec.Command("bash", "-c", stage)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Stderr = &p.stderr
+		cmds = append(cmds, cmd)
+	}
+
+	for i := 0; i < len(cmds)-1; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		pipes = append(pipes, r, w)
+		cmds[i].Stdout = w
+		cmds[i+1].Stdin = r
+	}
+	cmds[len(cmds)-1].Stdout = &p.output
+
+	for i, cmd := range cmds {
+		if err := cmd.Start(); err != nil {
+			for _, started := range cmds[:i] {
+				started.Process.Kill()
+				started.Wait()
+			}
+			return errors.Errorf("start stage %d failed, err: %s", i, err.Error())
+		}
+	}
+
+	p.cmds = cmds
+	return nil
+}
+
+// Wait wait all stages exit, return the error of the last failed stage like `set -o pipefail`
+func (p *Pipeline) Wait() error {
+	if p.cmds == nil {
+		return errors.New("pipeline not started")
+	}
+
+	var last error
+	for _, cmd := range p.cmds {
+		if err := cmd.Wait(); err != nil {
+			last = formatExitCode(err)
+		}
+	}
+	return last
+}
+
+// Run start and wait all stages exit
+func (p *Pipeline) Run() error {
+	if err := p.Start(); err != nil {
+		return err
+	}
+	return p.Wait()
+}
+
+// Signal send signal to the stage at index
+func (p *Pipeline) Signal(index int, sig syscall.Signal) error {
+	if p.cmds == nil {
+		return errors.New("pipeline not started")
+	}
+	if index < 0 || index >= len(p.cmds) {
+		return errors.Errorf("invalid stage index %d, pipeline has %d stages", index, len(p.cmds))
+	}
+	return p.cmds[index].Process.Signal(sig)
+}
+
+// Output stdout of the last stage, valid after Wait
+func (p *Pipeline) Output() string {
+	return p.output.String()
+}
+
+// Stderr stderr of all stages, valid after Wait
+func (p *Pipeline) Stderr() string {
+	return p.stderr.String()
+}
+
+// ExitCodes exit code of every stage, -1 if the stage is running or killed by signal
+func (p *Pipeline) ExitCodes() []int {
+	codes := make([]int, len(p.cmds))
+	for i, cmd := range p.cmds {
+		codes[i] = cmd.ProcessState.ExitCode()
+	}
+	return codes
+}
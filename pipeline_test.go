@@ -0,0 +1,40 @@
+package shell
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeline(t *testing.T) {
+	p := NewPipeline("echo 3; echo 1; echo 2", "sort", "head -n 2")
+	err := p.Run()
+
+	assert.Nil(t, err)
+	assert.Equal(t, p.Output(), "1\n2\n")
+	assert.Equal(t, p.ExitCodes(), []int{0, 0, 0})
+}
+
+func TestPipelineSignal(t *testing.T) {
+	p := NewPipeline("sleep 1; echo first-done >&2", "sleep 30")
+	err := p.Start()
+	assert.Nil(t, err)
+
+	start := time.Now()
+	time.Sleep(200 * time.Millisecond)
+	assert.Nil(t, p.Signal(1, syscall.SIGTERM))
+	assert.NotNil(t, p.Signal(2, syscall.SIGTERM))
+
+	err = p.Wait()
+	assert.NotNil(t, err)
+	assert.Less(t, time.Since(start).Seconds(), float64(3))
+
+	// the first stage finished normally, the second stage is terminated by signal
+	assert.Equal(t, p.ExitCodes(), []int{0, -1})
+	assert.Equal(t, p.Stderr(), "first-done\n")
+	ws := p.cmds[1].ProcessState.Sys().(syscall.WaitStatus)
+	assert.True(t, ws.Signaled())
+	assert.Equal(t, ws.Signal(), syscall.SIGTERM)
+}
@@ -0,0 +1,10 @@
+package shell
+
+// ProcInfo process info, RSS unit byte
+type ProcInfo struct {
+	PID     int
+	PPID    int
+	Name    string
+	Cmdline string
+	RSS     int64
+}
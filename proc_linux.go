@@ -0,0 +1,179 @@
+package shell
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ListProcesses list the processes from /proc, the processes exiting during the scan are skipped.
+func ListProcesses() ([]ProcInfo, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	procs := make([]ProcInfo, 0, len(entries))
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		info, err := readProcInfo(pid)
+		if err != nil {
+			continue
+		}
+		procs = append(procs, info)
+	}
+	return procs, nil
+}
+
+func readProcInfo(pid int) (ProcInfo, error) {
+	info := ProcInfo{PID: pid}
+
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return info, err
+	}
+
+	// pid (comm) state ppid ..., the comm may contain spaces and parentheses
+	start := bytes.IndexByte(stat, '(')
+	end := bytes.LastIndexByte(stat, ')')
+	if start < 0 || end < start {
+		return info, errors.Errorf("invalid stat of pid %d", pid)
+	}
+	info.Name = string(stat[start+1 : end])
+
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 22 {
+		return info, errors.Errorf("invalid stat of pid %d", pid)
+	}
+	info.PPID, _ = strconv.Atoi(fields[1])
+	rss, _ := strconv.ParseInt(fields[21], 10, 64)
+	info.RSS = rss * int64(os.Getpagesize())
+
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err == nil {
+		info.Cmdline = strings.TrimSpace(string(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1)))
+	}
+	return info, nil
+}
+
+// processGroupAlive whether any process of the group isn't exited, the zombies not reaped by init are ignored
+func processGroupAlive(pgid int) bool {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return syscall.Kill(-pgid, 0) == nil
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid pgrp ...
+		end := bytes.LastIndexByte(stat, ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[end+1:]))
+		if len(fields) < 3 || fields[0] == "Z" {
+			continue
+		}
+		if pgrp, _ := strconv.Atoi(fields[2]); pgrp == pgid {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPortListening whether a local socket is listening on port, read from /proc/net without shelling out.
+// proto: tcp, tcp4, tcp6, udp, udp4, udp6, tcp and udp match both ipv4 and ipv6.
+func CheckPortListening(proto string, port int) (bool, error) {
+	files, state, err := procNetFiles(proto)
+	if err != nil {
+		return false, err
+	}
+
+	for _, fname := range files {
+		bs, err := ioutil.ReadFile(fname)
+		if os.IsNotExist(err) {
+			continue // ipv6 is disabled
+		}
+		if err != nil {
+			return false, err
+		}
+
+		// sl local_address rem_address st ..., the address is hex ip:port
+		lines := strings.Split(string(bs), "\n")
+		for _, line := range lines[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[3] != state {
+				continue
+			}
+			idx := strings.LastIndexByte(fields[1], ':')
+			if idx < 0 {
+				continue
+			}
+			p, err := strconv.ParseInt(fields[1][idx+1:], 16, 32)
+			if err == nil && int(p) == port {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// procNetFiles the /proc/net files of proto and the hex socket state of listening, udp is unconnected
+func procNetFiles(proto string) ([]string, string, error) {
+	switch proto {
+	case "tcp":
+		return []string{"/proc/net/tcp", "/proc/net/tcp6"}, "0A", nil
+	case "tcp4":
+		return []string{"/proc/net/tcp"}, "0A", nil
+	case "tcp6":
+		return []string{"/proc/net/tcp6"}, "0A", nil
+	case "udp":
+		return []string{"/proc/net/udp", "/proc/net/udp6"}, "07", nil
+	case "udp4":
+		return []string{"/proc/net/udp"}, "07", nil
+	case "udp6":
+		return []string{"/proc/net/udp6"}, "07", nil
+	}
+	return nil, "", errors.Errorf("unsupported proto %s", proto)
+}
+
+// procDiagnostics dump /proc/<pid>/status and the open fds of the process for debugging
+func procDiagnostics(pid int) string {
+	var buf bytes.Buffer
+
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		fmt.Fprintf(&buf, "read status failed, err: %s\n", err.Error())
+	}
+	buf.Write(status)
+
+	fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		fmt.Fprintf(&buf, "read fd failed, err: %s\n", err.Error())
+	}
+	buf.WriteString("fd:\n")
+	for _, fd := range fds {
+		target, _ := os.Readlink(fdDir + "/" + fd.Name())
+		fmt.Fprintf(&buf, "%s -> %s\n", fd.Name(), target)
+	}
+	return buf.String()
+}
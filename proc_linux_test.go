@@ -0,0 +1,89 @@
+package shell
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListProcesses(t *testing.T) {
+	procs, err := ListProcesses()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, procs)
+
+	var self *ProcInfo
+	for i := range procs {
+		if procs[i].PID == os.Getpid() {
+			self = &procs[i]
+		}
+	}
+
+	assert.NotNil(t, self)
+	assert.Equal(t, self.PPID, os.Getppid())
+	assert.NotEmpty(t, self.Name)
+	assert.Contains(t, self.Cmdline, os.Args[0])
+	assert.Greater(t, self.RSS, int64(0))
+}
+
+func TestWithTimeoutDiagnostics(t *testing.T) {
+	cmd := NewCommand("sleep 5", WithTimeout(1), WithTimeoutDiagnostics())
+	cmd.Run()
+
+	assert.True(t, errors.Is(cmd.Status.Error, ErrProcessTimeout))
+	assert.NotEmpty(t, cmd.Status.Diagnostics)
+	assert.Contains(t, cmd.Status.Diagnostics, "State:")
+	assert.Contains(t, cmd.Status.Diagnostics, "fd:\n0 -> ")
+}
+
+func TestWaitAll(t *testing.T) {
+	// the grandchild doesn't hold the pipes, Wait returns before it exits
+	cmd := NewCommand("(sleep 0.5) >/dev/null 2>&1 & echo started")
+	start := time.Now()
+	assert.Nil(t, cmd.Start())
+	assert.Nil(t, cmd.Wait())
+	assert.Less(t, time.Since(start).Seconds(), 0.4)
+	assert.True(t, processGroupAlive(cmd.Status.PID))
+
+	assert.Nil(t, cmd.WaitAll(5*time.Second))
+	assert.GreaterOrEqual(t, time.Since(start).Seconds(), 0.5)
+	assert.False(t, processGroupAlive(cmd.Status.PID))
+
+	cmd = NewCommand("(sleep 2) >/dev/null 2>&1 &")
+	cmd.Start()
+	assert.Equal(t, cmd.WaitAll(100*time.Millisecond), ErrProcessGroupAlive)
+	syscall.Kill(-cmd.Status.PID, syscall.SIGKILL)
+}
+
+func TestCheckPortListening(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	ok, err := CheckPortListening("tcp", port)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = CheckPortListening("tcp4", port)
+	assert.True(t, ok)
+	ok, _ = CheckPortListening("udp", port)
+	assert.False(t, ok)
+
+	ln.Close()
+	ok, err = CheckPortListening("tcp", port)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer udp.Close()
+	ok, err = CheckPortListening("udp", udp.LocalAddr().(*net.UDPAddr).Port)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	_, err = CheckPortListening("sctp", port)
+	assert.NotNil(t, err)
+}
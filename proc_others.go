@@ -0,0 +1,43 @@
+//go:build !linux
+// +build !linux
+
+package shell
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ListProcesses is only supported on linux
+func ListProcesses() ([]ProcInfo, error) {
+	return nil, errors.New("list processes is only supported on linux")
+}
+
+// procDiagnostics is only supported on linux
+func procDiagnostics(pid int) string {
+	return ""
+}
+
+// processGroupAlive whether any process of the group exists, the zombies are counted
+func processGroupAlive(pgid int) bool {
+	return syscall.Kill(-pgid, 0) == nil
+}
+
+// CheckPortListening whether a local tcp listener accepts on port by dialing localhost, udp isn't supported
+func CheckPortListening(proto string, port int) (bool, error) {
+	if !strings.HasPrefix(proto, "tcp") {
+		return false, errors.Errorf("unsupported proto %s", proto)
+	}
+
+	conn, err := net.DialTimeout(proto, net.JoinHostPort("localhost", strconv.Itoa(port)), time.Second)
+	if err != nil {
+		return false, nil
+	}
+	conn.Close()
+	return true, nil
+}
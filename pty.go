@@ -0,0 +1,57 @@
+package shell
+
+import (
+	"io"
+	"os"
+	"os/exec"
+)
+
+type ptyPair struct {
+	master *os.File
+	slave  *os.File
+	done   chan struct{}
+}
+
+// attachPty open a pseudo-terminal and use the slave as the controlling terminal and stdio of cmd.
+func (c *Cmd) attachPty(cmd *exec.Cmd) (*ptyPair, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	// a session leader can't change the process group, setsid already makes pgid = pid.
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+
+	tty := &ptyPair{
+		master: master,
+		slave:  slave,
+		done:   make(chan struct{}),
+	}
+	c.ptyDone = tty.done
+	return tty, nil
+}
+
+// start copy the terminal output to w until the slave side is closed by the child.
+func (p *ptyPair) start(startErr error, w io.Writer) {
+	p.slave.Close()
+	if startErr != nil {
+		p.master.Close()
+		close(p.done)
+		return
+	}
+
+	go func() {
+		defer close(p.done)
+		defer p.master.Close()
+
+		// read returns EIO once the child exited
+		io.Copy(w, p.master)
+	}()
+}
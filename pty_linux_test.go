@@ -0,0 +1,21 @@
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithPTY(t *testing.T) {
+	script := "if [ -t 0 ] && [ -t 1 ]; then echo -n is-tty; else echo -n not-tty; fi"
+
+	cmd := NewCommand(script)
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, "not-tty")
+
+	cmd = NewCommand(script, WithPTY())
+	cmd.Run()
+	assert.Nil(t, cmd.Status.Error)
+	assert.Equal(t, cmd.Status.Output, "is-tty")
+	assert.Equal(t, cmd.Status.Stdout, "is-tty")
+}
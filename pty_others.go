@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package shell
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func openPty() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("pty is only supported on linux")
+}
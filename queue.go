@@ -0,0 +1,132 @@
+package shell
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var ErrQueueClosed = errors.New("queue closed")
+
+// Queue run the enqueued commands one at a time in FIFO order
+type Queue struct {
+	sync.Mutex
+
+	pending []queueItem
+	running *Cmd
+	closed  bool
+
+	wake chan struct{}
+	done chan struct{} // closed when the worker exits
+}
+
+type queueItem struct {
+	cmd    *Cmd
+	result chan Status
+}
+
+func NewQueue() *Queue {
+	q := &Queue{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go q.loop()
+	return q
+}
+
+// Enqueue append cmd to the queue, the final status is sent to the returned chan after cmd exits.
+// the status error is ErrQueueClosed when the queue is closed.
+func (q *Queue) Enqueue(cmd *Cmd) <-chan Status {
+	result := make(chan Status, 1)
+
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		result <- Status{Error: ErrQueueClosed}
+		close(result)
+		return result
+	}
+
+	q.pending = append(q.pending, queueItem{cmd: cmd, result: result})
+	q.notify()
+	return result
+}
+
+// Len the number of the pending commands, the running one isn't counted
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.pending)
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) loop() {
+	defer close(q.done)
+
+	for {
+		q.Lock()
+		if len(q.pending) == 0 {
+			closed := q.closed
+			q.Unlock()
+			if closed {
+				return
+			}
+			<-q.wake
+			continue
+		}
+
+		item := q.pending[0]
+		q.pending = q.pending[1:]
+		q.running = item.cmd
+		q.Unlock()
+
+		item.cmd.Run()
+
+		q.Lock()
+		q.running = nil
+		q.Unlock()
+
+		item.cmd.Lock()
+		item.result <- item.cmd.Status
+		item.cmd.Unlock()
+		close(item.result)
+	}
+}
+
+// Close stop accepting the commands, wait the pending commands finish
+func (q *Queue) Close() error {
+	q.Lock()
+	q.closed = true
+	q.notify()
+	q.Unlock()
+
+	<-q.done
+	return nil
+}
+
+// CloseNow stop accepting the commands, stop the running command and cancel the pending ones with ErrQueueClosed
+func (q *Queue) CloseNow() error {
+	q.Lock()
+	q.closed = true
+	for _, item := range q.pending {
+		item.result <- Status{Error: ErrQueueClosed}
+		close(item.result)
+	}
+	q.pending = nil
+	if q.running != nil {
+		// the worker may be starting it, it's canceled before the process is published
+		q.running.stopOrCancel()
+	}
+	q.notify()
+	q.Unlock()
+
+	<-q.done
+	return nil
+}
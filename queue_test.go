@@ -0,0 +1,82 @@
+package shell
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-shell-queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "log")
+
+	q := NewQueue()
+	var results []<-chan Status
+	for i := 1; i <= 3; i++ {
+		// the first command is the slowest, the later ones still run after it
+		script := fmt.Sprintf("sleep 0.%d; echo %d >> %s; echo out %d; exit %d", 4-i, i, logFile, i, i)
+		results = append(results, q.Enqueue(NewCommand(script)))
+	}
+
+	for i, result := range results {
+		status := <-result
+		assert.Equal(t, status.ExitCode, i+1)
+		assert.Equal(t, status.Output, fmt.Sprintf("out %d\n", i+1))
+	}
+	bs, err := ioutil.ReadFile(logFile)
+	assert.Nil(t, err)
+	assert.Equal(t, string(bs), "1\n2\n3\n")
+
+	// the pending commands are drained by Close
+	result := q.Enqueue(NewCommand("sleep 0.1; echo last"))
+	assert.Nil(t, q.Close())
+	assert.Equal(t, (<-result).Output, "last\n")
+
+	status := <-q.Enqueue(NewCommand("echo closed"))
+	assert.Equal(t, status.Error, ErrQueueClosed)
+}
+
+func TestQueueCloseNow(t *testing.T) {
+	q := NewQueue()
+	running := q.Enqueue(NewCommand("sleep 5"))
+	pending := q.Enqueue(NewCommand("echo pending"))
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	assert.Nil(t, q.CloseNow())
+	assert.Less(t, time.Since(start).Seconds(), float64(1))
+
+	assert.Equal(t, (<-running).ExitCode, -1)
+	assert.Equal(t, (<-pending).Error, ErrQueueClosed)
+}
+
+func TestQueueCloseNowStarting(t *testing.T) {
+	// CloseNow while the worker is starting the command, the process isn't published yet
+	starting := make(chan struct{})
+	q := NewQueue()
+	result := q.Enqueue(NewCommand("sleep 5", WithCmdHook(func(*exec.Cmd) {
+		close(starting)
+		time.Sleep(100 * time.Millisecond)
+	})))
+	<-starting
+
+	start := time.Now()
+	assert.Nil(t, q.CloseNow())
+	status := <-result
+	assert.Less(t, time.Since(start).Seconds(), float64(1))
+	assert.Equal(t, status.ExitCode, -1)
+
+	// canceled before start
+	cmd := NewCommand("sleep 5")
+	cmd.stopOrCancel()
+	assert.Equal(t, cmd.Run(), ErrProcessCancel)
+	assert.Nil(t, cmd.stdcmd)
+}
@@ -0,0 +1,128 @@
+package shell
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// WithRetry run the command up to attempts times by Run until it succeeds, sleep backoff between the attempts.
+// the output writers see every attempt, the exit hooks are called once after the last attempt.
+func WithRetry(attempts int, backoff time.Duration) optionFunc {
+	return func(o *Cmd) error {
+		o.retryAttempts = attempts
+		o.retryBackoff = backoff
+		return nil
+	}
+}
+
+// WithMaxElapsed cap the total time of the retry attempts, the running attempt is killed with ErrProcessTimeout
+// when d is exceeded and no more attempt is started.
+func WithMaxElapsed(d time.Duration) optionFunc {
+	return func(o *Cmd) error {
+		o.maxElapsed = d
+		return nil
+	}
+}
+
+// WithRetryIf retry the attempt when fn returns true for its status, example: the output contains a transient
+// error while the exit code is 0. default retry the failed attempt, see Status.Success.
+func WithRetryIf(fn func(Status) bool) optionFunc {
+	return func(o *Cmd) error {
+		o.retryIf = fn
+		return nil
+	}
+}
+
+func (c *Cmd) shouldRetry() bool {
+	if c.retryIf != nil {
+		return c.retryIf(c.Status)
+	}
+	return !c.Status.Success()
+}
+
+// runRetry run the command until it succeeds or the attempts are used up, return the error of the last attempt.
+// the start error isn't retried, it's a config error.
+func (c *Cmd) runRetry() error {
+	c.holdExitHooks = true
+	defer func() {
+		c.holdExitHooks = false
+		c.runExitHooks()
+	}()
+
+	begin := time.Now()
+	if c.maxElapsed > 0 {
+		// every attempt gets the remaining budget at most
+		deadline := c.deadline
+		if budget := begin.Add(c.maxElapsed); deadline.IsZero() || budget.Before(deadline) {
+			c.deadline = budget
+		}
+		defer func() {
+			c.deadline = deadline
+		}()
+	}
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			c.reset()
+		}
+
+		err := c.Start()
+		if err == nil && !c.detach {
+			<-c.exited
+		}
+		c.Status.Attempts = attempt
+		if err != nil {
+			return err
+		}
+
+		if !c.shouldRetry() || attempt >= c.retryAttempts || c.detach {
+			break
+		}
+		if c.ctx.Err() == context.Canceled {
+			break // stopped by the caller
+		}
+		if c.maxElapsed > 0 && time.Since(begin)+c.retryBackoff >= c.maxElapsed {
+			c.logf("retry max elapsed %v exceeded, attempts: %d", c.maxElapsed, attempt)
+			break
+		}
+
+		c.logf("retry command after %v, attempt: %d, err: %v", c.retryBackoff, attempt+1, c.Status.Error)
+		time.Sleep(c.retryBackoff)
+	}
+	return c.Status.Error
+}
+
+// CommandRetry run the easy command up to attempts times until it exits 0, sleep a random duration in
+// [0, base*2^(n-1)) after the n-th failed attempt, the exponential backoff with full jitter.
+// return CombinedOutput, exitcode, err of the last attempt
+func CommandRetry(args string, attempts int, base time.Duration) (string, int, error) {
+	var (
+		out  string
+		code int
+		err  error
+	)
+	for attempt := 1; attempt <= attempts; attempt++ {
+		out, code, err = Command(args)
+		if err == nil && code == 0 {
+			break
+		}
+		if attempt < attempts {
+			time.Sleep(backoffJitter(base, attempt))
+		}
+	}
+	return out, code, err
+}
+
+// backoffJitter random duration in [0, base*2^(attempt-1)), the shift is capped to avoid the overflow
+func backoffJitter(base time.Duration, attempt int) time.Duration {
+	shift := attempt - 1
+	if shift > 30 {
+		shift = 30
+	}
+	max := base << uint(shift)
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
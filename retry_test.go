@@ -0,0 +1,118 @@
+package shell
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// counterScript exit 0 from the n-th run, the runs are counted in a file
+func counterScript(t *testing.T, n int) string {
+	dir, err := ioutil.TempDir("", "go-shell-retry")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	fpath := filepath.Join(dir, "counter")
+	return fmt.Sprintf(`n=$(cat %[1]s 2>/dev/null || echo 0); n=$((n+1)); echo $n > %[1]s; echo attempt $n; [ $n -ge %[2]d ]`, fpath, n)
+}
+
+func TestWithRetry(t *testing.T) {
+	var exits int
+	cmd := NewCommand(counterScript(t, 3), WithRetry(5, 10*time.Millisecond))
+	cmd.exitHooks = append(cmd.exitHooks, func(Status) { exits++ })
+
+	err := cmd.Run()
+	assert.Nil(t, err)
+	assert.Equal(t, cmd.Status.Attempts, 3)
+	assert.Equal(t, cmd.Status.ExitCode, 0)
+	assert.Equal(t, cmd.Status.Output, "attempt 3\n")
+	assert.Equal(t, exits, 1)
+
+	cmd = NewCommand(counterScript(t, 10), WithRetry(2, 10*time.Millisecond))
+	err = cmd.Run()
+	assert.NotNil(t, err)
+	assert.Equal(t, cmd.Status.Attempts, 2)
+	assert.Equal(t, cmd.Status.ExitCode, 1)
+}
+
+func TestWithMaxElapsed(t *testing.T) {
+	start := time.Now()
+	cmd := NewCommand("sleep 0.3; exit 1", WithRetry(10, 100*time.Millisecond), WithMaxElapsed(time.Second))
+	err := cmd.Run()
+
+	// the 3rd attempt is killed when the budget is exceeded
+	assert.Equal(t, err, ErrProcessTimeout)
+	assert.Greater(t, cmd.Status.Attempts, 1)
+	assert.LessOrEqual(t, cmd.Status.Attempts, 3)
+	assert.Less(t, time.Since(start).Seconds(), 1.2)
+
+	// the running attempt is bounded by the budget
+	start = time.Now()
+	cmd = NewCommand("sleep 5", WithRetry(3, 0), WithMaxElapsed(500*time.Millisecond))
+	err = cmd.Run()
+	assert.Equal(t, err, ErrProcessTimeout)
+	assert.Equal(t, cmd.Status.Attempts, 1)
+	assert.GreaterOrEqual(t, time.Since(start).Seconds(), 0.5)
+	assert.Less(t, time.Since(start).Seconds(), 0.7)
+}
+
+func TestWithRetryIf(t *testing.T) {
+	// exit 0 with a transient error before the 3rd run
+	script := counterScript(t, 3) + ` || echo "temporary failure"; exit 0`
+	cmd := NewCommand(script, WithRetry(5, 10*time.Millisecond), WithRetryIf(func(s Status) bool {
+		return strings.Contains(s.Output, "temporary failure")
+	}))
+
+	err := cmd.Run()
+	assert.Nil(t, err)
+	assert.Equal(t, cmd.Status.Attempts, 3)
+	assert.Equal(t, cmd.Status.Output, "attempt 3\n")
+
+	// the failed attempt isn't retried when fn returns false
+	cmd = NewCommand("exit 1", WithRetry(5, 10*time.Millisecond), WithRetryIf(func(s Status) bool {
+		return false
+	}))
+	assert.NotNil(t, cmd.Run())
+	assert.Equal(t, cmd.Status.Attempts, 1)
+}
+
+func TestCommandRetry(t *testing.T) {
+	start := time.Now()
+	out, code, err := CommandRetry(counterScript(t, 3), 5, 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, code, 0)
+	assert.Equal(t, out, "attempt 3\n")
+	// the sleeps are below 50ms + 100ms
+	assert.Less(t, time.Since(start).Seconds(), 0.5)
+
+	out, code, err = CommandRetry(counterScript(t, 10), 2, time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Equal(t, code, 1)
+	assert.Equal(t, out, "attempt 2\n")
+}
+
+func TestBackoffJitter(t *testing.T) {
+	base := 10 * time.Millisecond
+	for attempt := 1; attempt <= 5; attempt++ {
+		max := base << uint(attempt-1)
+		var sum time.Duration
+		for i := 0; i < 100; i++ {
+			d := backoffJitter(base, attempt)
+			assert.GreaterOrEqual(t, int64(d), int64(0))
+			assert.Less(t, int64(d), int64(max))
+			sum += d
+		}
+		// the mean is around max/2, it doubles with the attempts
+		mean := sum / 100
+		assert.Greater(t, int64(mean), int64(max/4))
+		assert.Less(t, int64(mean), int64(max*3/4))
+	}
+	assert.Equal(t, backoffJitter(0, 1), time.Duration(0))
+	assert.Less(t, int64(backoffJitter(time.Second, 100)), int64(time.Second<<30))
+}
@@ -0,0 +1,143 @@
+package shell
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// RotateWriter write to path, rotate it to path.1 when the size reaches maxSize,
+// keep maxFiles backups: path.1 is the newest, path.<maxFiles> the oldest.
+type RotateWriter struct {
+	sync.Mutex
+
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File
+	size int64
+}
+
+func NewRotateWriter(path string, maxSize int64, maxFiles int) (*RotateWriter, error) {
+	w, err := newRotateWriter(path, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// newRotateWriter check the args, the file isn't opened until reopen
+func newRotateWriter(path string, maxSize int64, maxFiles int) (*RotateWriter, error) {
+	if maxSize <= 0 || maxFiles < 0 {
+		return nil, errors.Errorf("invalid rotate args, maxSize: %d, maxFiles: %d", maxSize, maxFiles)
+	}
+
+	return &RotateWriter{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}, nil
+}
+
+// reopen open the file if it's closed, WithOutputFile opens it on start
+func (w *RotateWriter) reopen() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file != nil {
+		return nil
+	}
+	return w.open()
+}
+
+func (w *RotateWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+// Write makes RotateWriter implement the io.Writer interface, a write crossing maxSize is split into the next file.
+func (w *RotateWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if w.size >= w.maxSize {
+			if err := w.rotate(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := p
+		if free := w.maxSize - w.size; int64(len(chunk)) > free {
+			chunk = chunk[:free]
+		}
+
+		n, err := w.file.Write(chunk)
+		w.size += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *RotateWriter) backup(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
+
+func (w *RotateWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	if w.maxFiles == 0 {
+		os.Remove(w.path)
+		return w.open()
+	}
+
+	os.Remove(w.backup(w.maxFiles))
+	for i := w.maxFiles - 1; i >= 1; i-- {
+		os.Rename(w.backup(i), w.backup(i+1))
+	}
+	if err := os.Rename(w.path, w.backup(1)); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *RotateWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
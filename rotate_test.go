@@ -0,0 +1,63 @@
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithOutputFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-shell-rotate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fpath := dir + "/output.log"
+	cmd, err := NewCommandE("for i in $(seq 1 100); do echo 0123456789; done; echo last", WithOutputFile(fpath, 300, 2))
+	assert.Nil(t, err)
+	cmd.Run()
+	assert.Nil(t, cmd.Status.Error)
+
+	_, err = os.Stat(fpath + ".1")
+	assert.Nil(t, err)
+	_, err = os.Stat(fpath + ".2")
+	assert.Nil(t, err)
+	_, err = os.Stat(fpath + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	current, err := ioutil.ReadFile(fpath)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, len(current), 300)
+	assert.True(t, strings.HasSuffix(string(current), "last\n"))
+
+	backup, err := ioutil.ReadFile(fpath + ".1")
+	assert.Nil(t, err)
+	assert.Equal(t, len(backup), 300)
+	assert.True(t, strings.HasSuffix(cmd.Status.Output, string(backup)+string(current)))
+}
+
+func TestWithOutputFileError(t *testing.T) {
+	_, err := NewCommandE("echo 123", WithOutputFile("output.log", 0, 2))
+	assert.NotNil(t, err)
+
+	// the file is opened on Start
+	cmd, err := NewCommandE("echo 123", WithOutputFile("/not-exist-dir/output.log", 300, 2))
+	assert.Nil(t, err)
+	err = cmd.Start()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "open output file failed")
+}
+
+func TestWithOutputFileNotStarted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-shell-rotate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fpath := dir + "/output.log"
+	_, err = NewCommandE("echo 123", WithOutputFile(fpath, 300, 2))
+	assert.Nil(t, err)
+	_, err = os.Stat(fpath)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,14 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package shell
+
+import (
+	"os"
+)
+
+// fillRusage set the cpu times, MaxRSS isn't supported
+func fillRusage(status *Status, state *os.ProcessState) {
+	status.UserTime = state.UserTime()
+	status.SystemTime = state.SystemTime()
+}
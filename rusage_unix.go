@@ -0,0 +1,26 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package shell
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// fillRusage set the resource usage of the exited process to status
+func fillRusage(status *Status, state *os.ProcessState) {
+	status.UserTime = state.UserTime()
+	status.SystemTime = state.SystemTime()
+
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok || rusage == nil {
+		return
+	}
+
+	status.MaxRSS = int64(rusage.Maxrss)
+	if runtime.GOOS != "darwin" {
+		status.MaxRSS *= 1024 // kilobytes except darwin
+	}
+}
@@ -0,0 +1,20 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusRusage(t *testing.T) {
+	// allocate about 50MB in the shell
+	cmd := NewCommand(`s=$(head -c 50000000 /dev/zero | tr '\0' 'a'); echo ${#s}`)
+	cmd.Run()
+
+	assert.Equal(t, cmd.Status.Output, "50000000\n")
+	assert.Greater(t, cmd.Status.MaxRSS, int64(1024*1024))
+	assert.Greater(t, int64(cmd.Status.UserTime+cmd.Status.SystemTime), int64(0))
+}
@@ -0,0 +1,49 @@
+//go:build go1.23
+// +build go1.23
+
+package shell
+
+import (
+	"iter"
+)
+
+// LinesSeq start the command, yield every stdout and stderr line as it runs, then the error of the
+// command if it failed. the command is stopped when the loop breaks. must be called before Start.
+// usage: for line, err := range cmd.LinesSeq() { ... }
+func (c *Cmd) LinesSeq() iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		lines := make(chan string, 128)
+		send := func(line string) {
+			lines <- line
+		}
+
+		stdout := newLineWriter(send)
+		stderr := newLineWriter(send)
+		c.stdoutWriters = append(c.stdoutWriters, stdout)
+		c.stderrWriters = append(c.stderrWriters, stderr)
+		c.exitHooks = append(c.exitHooks, func(Status) {
+			stdout.Flush()
+			stderr.Flush()
+			close(lines)
+		})
+
+		if err := c.Start(); err != nil {
+			yield("", err)
+			return
+		}
+
+		for line := range lines {
+			if !yield(line, nil) {
+				c.Stop()
+				for range lines {
+					// drain until the output is closed
+				}
+				return
+			}
+		}
+
+		if err := c.Wait(); err != nil {
+			yield("", err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+//go:build go1.23
+// +build go1.23
+
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinesSeq(t *testing.T) {
+	var lines []string
+	cmd := NewCommand("echo a; echo b; printf c")
+	for line, err := range cmd.LinesSeq() {
+		assert.Nil(t, err)
+		lines = append(lines, line)
+	}
+	assert.Equal(t, lines, []string{"a", "b", "c"})
+	assert.Equal(t, cmd.Status.ExitCode, 0)
+
+	// the error is yielded after the lines
+	lines = nil
+	var last error
+	for line, err := range NewCommand("echo a; exit 3").LinesSeq() {
+		if err != nil {
+			last = err
+			continue
+		}
+		lines = append(lines, line)
+	}
+	assert.Equal(t, lines, []string{"a"})
+	assert.NotNil(t, last)
+
+	// break stops the command
+	cmd = NewCommand("while true; do echo loop; done")
+	for range cmd.LinesSeq() {
+		break
+	}
+	assert.Equal(t, cmd.Status.Finish, true)
+}
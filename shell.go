@@ -9,12 +9,18 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
 )
 
 var (
@@ -26,14 +32,43 @@ var (
 	ErrInvalidArgs          = errors.New("Invalid argument to exit")
 	ErrProcessTimeout       = errors.New("throw process timeout")
 	ErrProcessCancel        = errors.New("active cancel process")
+	ErrIdleTimeout          = errors.New("throw process idle timeout")
+	ErrNotReady             = errors.New("wait process ready timeout")
+	ErrShellNotFound        = errors.New("shell not found in PATH, install bash or sh, or set one by WithShell")
+	ErrProcessGroupAlive    = errors.New("wait process group exit timeout")
+	ErrOOMKilled            = errors.New("process killed by the oom killer")
+	ErrStdinConflict        = errors.New("stdin is already set by the other stdin option")
+	ErrCommandSkipped       = errors.New("condition not met, command skipped")
 
 	DefaultExitCode = 2
+
+	// DefaultAuditStdinLimit the max bytes of Status.StdinCapture, the rest of stdin isn't captured
+	DefaultAuditStdinLimit = 1 << 20
+
+	// DefaultMaxLineBufferSize the cap of the line buffer of OutputStream set by WithGrowableLineBuffer
+	DefaultMaxLineBufferSize = 16 << 20
+
+	// DefaultRedactEnvPattern env keys matching it are masked in the logs
+	DefaultRedactEnvPattern = regexp.MustCompile(`(?i)(TOKEN|SECRET|PASSWORD)`)
 )
 
+// Logger debug logger, *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+
 type Cmd struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	// parent of ctx returned by Context, it's canceled once after the final exit
+	lifeCtx    context.Context
+	lifeCancel context.CancelFunc
+
 	stdcmd *exec.Cmd
 
 	sync.Mutex
@@ -46,14 +81,78 @@ type Cmd struct {
 
 	isFinalized bool
 
-	timeout int
+	args []string // exec mode argv, split from Bash on first use
+
+	timeout      int
+	timeoutTimer *time.Timer // stopped in finalize, don't leak until it fires
+	deadline     time.Time
+	timeoutDiag  bool
+	timeoutGrace time.Duration
+	idleTimeout  time.Duration
+	encoding     encoding.Encoding
+	cmdHooks     []func(*exec.Cmd)
+	extraFiles   []*os.File
+	openers      []func() error // open the output files on start, they're closed by the exit hooks
+	stdin        io.Reader
+	stdinFile    string // opened on start, closed after the process started
+	inheritStdin bool
+	auditStdin   bool
+	stdinAudit   *limitBuffer
+	stdinCloser  io.Closer // the stdin file read by the audit tee, closed after the exit
+	pidFile      string
+	detach       bool
+	pidFileKill  bool
+	outputFilter func(line string) string
+	flushers     []func() // flush the writer wrappers after the process exit, the outermost first
+	umask        int
+	logger       Logger
+	name         string // label in the logs and errors
+	stderrTail   int
+	shellFlag    string
+	shell        string // empty is bash, fallback to sh
+	pty          bool
+	combined     bool
+	posixSignal  bool
+	exitCodeErrs map[int]error
+	oomDetect    bool
+	oomKills     int64 // the system oom kill counter before start, -1 is unsupported
+	strict       bool
+	outputCap    int
+	ptyDone      chan struct{}
+	redactEnv    map[string]bool
+	captureEnv   bool
+	idle         *idleWriter
+	release      func() // release the slot of the max concurrency
+	tokenAcquire func() (func(), error)
+	tokenRelease func()
+	lockPath     string
+	lockTimeout  time.Duration
+	lockFile     *os.File
+
+	retryAttempts int
+	retryBackoff  time.Duration
+	maxElapsed    time.Duration
+	retryIf       func(Status) bool
+	holdExitHooks bool // the exit hooks are called once after the last retry attempt
+	cancelStart   bool // set by stopOrCancel, the later Start fails with ErrProcessCancel
 
 	statusChan chan Status
 	doneChan   chan error
+	exited     chan struct{} // closed after handleWait returns and the exit hooks are called
 
-	output bytes.Buffer // stdout + stderr
+	output syncBuffer // stdout + stderr, the lock guards stdout and stderr too
 	stdout bytes.Buffer
 	stderr bytes.Buffer
+
+	stdoutCounter countWriter
+	stderrCounter countWriter
+
+	// extra writers and hooks registered by the stream apis
+	stdoutWriters []io.Writer
+	stderrWriters []io.Writer
+	exitHooks     []func(Status) // called once after the process exit and stdio is drained
+
+	events chan Event
 }
 
 type Status struct {
@@ -63,14 +162,41 @@ type Status struct {
 	Error    error
 	CostTime time.Duration
 
-	Output string // stdout + stderr
+	CmdError *CmdError // Error with the command context, set when the command fails
+
+	Output string // stdout + stderr, whole writes interleaved in the order they are read from the pipes
 	Stdout string
 	Stderr string
 
+	StdoutBytes int64
+	StderrBytes int64
+
+	ResolvedDir string // absolute work dir set by WithSetDir
+
+	Attempts int // runs of the command, more than 1 when retried by WithRetry
+
+	StdinCapture string // the stdin fed to the command captured by WithAuditStdin, up to DefaultAuditStdinLimit bytes
+
+	CallbackError error // the first panic recovered from the WithLineCallback callback
+
+	Env []string // the effective env of the process captured by WithCaptureEnv, the secret values are masked
+
+	Diagnostics string // /proc status and fds of the process captured on timeout by WithTimeoutDiagnostics
+
+	// resource usage of the exited process, MaxRSS is the peak resident set size in bytes, unix only
+	MaxRSS     int64
+	UserTime   time.Duration
+	SystemTime time.Duration
+
 	startTime time.Time
 	endTime   time.Time
 }
 
+// Success the command exited with code 0 and no error, ExitCode is the raw code of the process
+func (s Status) Success() bool {
+	return s.ExitCode == 0 && s.Error == nil
+}
+
 type optionFunc func(*Cmd) error
 
 // WithTimeout command timeout, unit second
@@ -85,332 +211,2016 @@ func WithTimeout(td int) optionFunc {
 	}
 }
 
-// WithShellMode set shell mode
-func WithShellMode() optionFunc {
+// WithDeadline kill the command at t like WithTimeout, Start returns ErrProcessTimeout when t has passed
+func WithDeadline(t time.Time) optionFunc {
 	return func(o *Cmd) error {
-		o.ShellMode = true
+		o.deadline = t
 		return nil
 	}
 }
 
-// WithExecMode set exec mode, example: ["curl", "-i", "-v", "xiaorui.cc"]
-func WithExecMode(b bool) optionFunc {
+// WithTimeoutGrace send SIGTERM to the process group on timeout, SIGKILL it if it's still running after d
+func WithTimeoutGrace(d time.Duration) optionFunc {
 	return func(o *Cmd) error {
-		o.ShellMode = false
+		o.timeoutGrace = d
 		return nil
 	}
 }
 
-// WithSetDir set work dir
-func WithSetDir(dir string) optionFunc {
+// WithTimeoutDiagnostics capture /proc/<pid>/status and the open fds into Status.Diagnostics on timeout,
+// then send SIGQUIT to the process group before killing, a go child dumps the goroutine stacks to Status.Stderr.
+func WithTimeoutDiagnostics() optionFunc {
 	return func(o *Cmd) error {
-		o.Dir = dir
+		o.timeoutDiag = true
 		return nil
 	}
 }
 
-// WithSetEnv set env
-func WithSetEnv(env []string) optionFunc {
+// WithIdleTimeout kill the command when it produces no output for d
+func WithIdleTimeout(d time.Duration) optionFunc {
+	if d < 0 {
+		panic("idle timeout > 0")
+	}
+
 	return func(o *Cmd) error {
-		o.Env = env
+		o.idleTimeout = d
 		return nil
 	}
 }
 
-func NewCommand(bash string, options ...optionFunc) *Cmd {
-	c := &Cmd{
-		Bash:       bash,
-		Status:     Status{},
-		ShellMode:  true,
-		statusChan: make(chan Status, 1),
-		doneChan:   make(chan error, 1),
+// WithOutputEncoding transcode output from enc to UTF-8 before buffering, default passthrough.
+// example: WithOutputEncoding(simplifiedchinese.GBK)
+func WithOutputEncoding(enc encoding.Encoding) optionFunc {
+	return func(o *Cmd) error {
+		o.encoding = enc
+		return nil
 	}
-	for _, opt := range options {
-		opt(c)
+}
+
+// WithOutputFilter transform every output line before it's buffered or streamed, example: mask the tokens
+func WithOutputFilter(fn func(line string) string) optionFunc {
+	return func(o *Cmd) error {
+		o.outputFilter = fn
+		return nil
 	}
-	return c
 }
 
-// Clone new Cmd with current config
-func (c *Cmd) Clone() *Cmd {
-	return NewCommand(c.Bash)
+// WithCmdHook call fn with the underlying exec.Cmd right before Start, for the advanced tweaks, example: ExtraFiles
+func WithCmdHook(fn func(*exec.Cmd)) optionFunc {
+	return func(o *Cmd) error {
+		o.cmdHooks = append(o.cmdHooks, fn)
+		return nil
+	}
 }
 
-// Start async execute command
-func (c *Cmd) Start() error {
-	if c.Status.Finish {
-		return ErrAlreadyFinished
+// WithStdin read the stdin of the command from r
+func WithStdin(r io.Reader) optionFunc {
+	return func(o *Cmd) error {
+		if o.inheritStdin {
+			return ErrStdinConflict
+		}
+		o.stdin = r
+		return nil
 	}
+}
 
-	return c.run()
+// WithStdinFile read the stdin of the command from the file, it's opened on Start and closed after the process started
+func WithStdinFile(path string) optionFunc {
+	return func(o *Cmd) error {
+		if o.inheritStdin {
+			return ErrStdinConflict
+		}
+		o.stdinFile = path
+		return nil
+	}
 }
 
-// Wait wait command finish
-func (c *Cmd) Wait() error {
-	<-c.doneChan
-	return c.Status.Error
+// WithInheritStdin the command reads the os.Stdin of the parent, example: the interactive wrappers.
+// it can't be combined with WithStdin or WithStdinFile.
+func WithInheritStdin() optionFunc {
+	return func(o *Cmd) error {
+		if o.stdin != nil || o.stdinFile != "" {
+			return ErrStdinConflict
+		}
+		o.inheritStdin = true
+		return nil
+	}
 }
 
-// Run start and wait process exit
-func (c *Cmd) Run() error {
-	c.Start()
-	return c.Wait()
+// WithAuditStdin capture the stdin fed to the command into Status.StdinCapture for audit,
+// it works with WithStdin, WithStdinFile and WithInheritStdin, the capture is capped by DefaultAuditStdinLimit.
+func WithAuditStdin() optionFunc {
+	return func(o *Cmd) error {
+		o.auditStdin = true
+		return nil
+	}
 }
 
-func (c *Cmd) buildCtx() {
-	if c.timeout > 0 {
-		c.ctx, c.cancel = context.WithTimeout(context.Background(), time.Duration(c.timeout)*time.Second)
-	} else {
-		c.ctx, c.cancel = context.WithCancel(context.Background())
+// WithExtraFiles pass the open files to the child, files[i] becomes fd 3+i in the child
+func WithExtraFiles(files ...*os.File) optionFunc {
+	return func(o *Cmd) error {
+		o.extraFiles = append(o.extraFiles, files...)
+		return nil
 	}
 }
 
-func (c *Cmd) run() error {
-	var (
-		cmd *exec.Cmd
+// WithOutputFile write stdout and stderr to path, rotate it at maxSize bytes and keep maxFiles backups.
+// the file is opened on Start and closed after the exit, Start returns the open error.
+func WithOutputFile(path string, maxSize int64, maxFiles int) optionFunc {
+	return func(o *Cmd) error {
+		w, err := newRotateWriter(path, maxSize, maxFiles)
+		if err != nil {
+			return err
+		}
 
-		sysProcAttr *syscall.SysProcAttr
-	)
+		o.addOutputFile(w, w.reopen)
+		return nil
+	}
+}
 
-	c.buildCtx()
+// WithCompressedOutputFile write stdout and stderr to the gzip file path, the file is truncated on Start
+// and closed after the exit, Start returns the open error.
+func WithCompressedOutputFile(path string) optionFunc {
+	return func(o *Cmd) error {
+		w := newGzipFileWriter(path)
+		o.addOutputFile(w, w.open)
+		return nil
+	}
+}
 
-	sysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true,
+// addOutputFile write stdout and stderr to w, it's opened by open on start and closed after the exit
+func (c *Cmd) addOutputFile(w io.WriteCloser, open func() error) {
+	c.stdoutWriters = append(c.stdoutWriters, w)
+	c.stderrWriters = append(c.stderrWriters, w)
+	c.openers = append(c.openers, open)
+	c.exitHooks = append(c.exitHooks, func(Status) {
+		w.Close()
+	})
+}
+
+// WithPassthrough write the output to os.Stdout and os.Stderr of the parent in real time, it's still captured
+func WithPassthrough() optionFunc {
+	return func(o *Cmd) error {
+		o.stdoutWriters = append(o.stdoutWriters, os.Stdout)
+		o.stderrWriters = append(o.stderrWriters, os.Stderr)
+		return nil
 	}
+}
 
-	c.Status.startTime = time.Now()
-	if c.ShellMode {
-		cmd = exec.Command("bash", "-c", c.Bash)
-	} else {
-		args := strings.Split(c.Bash, " ")
-		cmd = exec.Command(args[0], args[1:]...)
+// WithOutputStream write stdout and stderr to the streams, nil is skipped. the channels of the streams are
+// closed after the command exits, the range over Lines ends when the output is drained.
+func WithOutputStream(stdout, stderr *OutputStream) optionFunc {
+	return func(o *Cmd) error {
+		if stdout != nil {
+			o.stdoutWriters = append(o.stdoutWriters, stdout)
+		}
+		if stderr != nil {
+			o.stderrWriters = append(o.stderrWriters, stderr)
+		}
+		o.exitHooks = append(o.exitHooks, func(Status) {
+			if stdout != nil {
+				stdout.finish()
+			}
+			if stderr != nil {
+				stderr.finish()
+			}
+		})
+		return nil
 	}
+}
 
-	cmd.Dir = c.Dir
-	cmd.Env = c.Env
-	cmd.SysProcAttr = sysProcAttr
+// WithLineWriter write every complete stdout and stderr line to w, prefix the RFC3339 timestamp if prefixTimestamp
+func WithLineWriter(w io.Writer, prefixTimestamp bool) optionFunc {
+	return func(o *Cmd) error {
+		var mu sync.Mutex
+		write := func(line string) {
+			if prefixTimestamp {
+				line = time.Now().Format(time.RFC3339) + " " + line
+			}
 
-	// merge multi writer
-	mergeStdout := io.MultiWriter(&c.output, &c.stdout)
-	mergeStderr := io.MultiWriter(&c.output, &c.stderr)
+			mu.Lock()
+			defer mu.Unlock()
+			io.WriteString(w, line+"\n")
+		}
 
-	// reset writer
-	cmd.Stdout = mergeStdout
-	cmd.Stderr = mergeStderr
-	c.stdcmd = cmd
+		stdout := newLineWriter(write)
+		stderr := newLineWriter(write)
+		o.stdoutWriters = append(o.stdoutWriters, stdout)
+		o.stderrWriters = append(o.stderrWriters, stderr)
+		o.exitHooks = append(o.exitHooks, func(Status) {
+			stdout.Flush()
+			stderr.Flush()
+		})
+		return nil
+	}
+}
 
-	// async start
-	err := c.stdcmd.Start()
-	if err != nil {
-		c.Status.Error = err
-		return err
+// WithPidFile write the pid to path after start, remove it on finalize.
+// the write error is set to Status.Error, the command keeps running unless WithPidFileKillOnError.
+func WithPidFile(path string) optionFunc {
+	return func(o *Cmd) error {
+		o.pidFile = path
+		return nil
 	}
+}
 
-	go c.handleWait()
+// WithPidFileKillOnError stop the command when the pid file can't be written
+func WithPidFileKillOnError() optionFunc {
+	return func(o *Cmd) error {
+		o.pidFileKill = true
+		return nil
+	}
+}
 
-	return nil
+// WithShellMode set shell mode
+func WithShellMode() optionFunc {
+	return func(o *Cmd) error {
+		o.ShellMode = true
+		return nil
+	}
 }
 
-func (c *Cmd) handleWait() error {
-	defer func() {
-		if c.Status.Finish {
-			return
-		}
-		c.statusChan <- c.Status
-		c.finalize()
-	}()
+// WithShell set the shell used in shell mode, default bash, fallback to sh when bash isn't installed
+func WithShell(shell string) optionFunc {
+	return func(o *Cmd) error {
+		o.shell = shell
+		return nil
+	}
+}
 
-	c.handleTimeout()
+// WithLoginShell run as login shell `bash -lc`, profile files are sourced
+func WithLoginShell() optionFunc {
+	return func(o *Cmd) error {
+		o.ShellMode = true
+		o.shellFlag = "-lc"
+		return nil
+	}
+}
 
-	// join process
-	err := c.stdcmd.Wait()
-	if c.ctx.Err() == context.DeadlineExceeded {
-		return err
+// WithInteractiveShell run as interactive shell `bash -ic`, .bashrc is sourced
+func WithInteractiveShell() optionFunc {
+	return func(o *Cmd) error {
+		o.ShellMode = true
+		o.shellFlag = "-ic"
+		return nil
 	}
-	if c.ctx.Err() == context.Canceled {
-		return err
+}
+
+// WithStrictMode prepend `set -euo pipefail;` to the command in shell mode, the failed command or pipe
+// and the unset variable abort the script. it's ignored in exec mode.
+func WithStrictMode() optionFunc {
+	return func(o *Cmd) error {
+		o.strict = true
+		return nil
 	}
+}
 
-	if err != nil {
-		c.Status.Error = formatExitCode(err)
-		return err
+// WithCombinedOrdering point stdout and stderr of the command to the same pipe, Output keeps the true emit order.
+// stderr can't be told apart then, it's written to Status.Stdout and the stdout writers, Status.Stderr is empty.
+func WithCombinedOrdering() optionFunc {
+	return func(o *Cmd) error {
+		o.combined = true
+		return nil
 	}
+}
 
-	c.Status.Stdout = c.stdout.String()
-	c.Status.Stderr = c.stderr.String()
-	c.Status.Output = c.output.String()
-	return nil
+// WithPosixSignalExitCodes set ExitCode to 128+n when the process is killed by signal n like `bash $?`, default -1
+func WithPosixSignalExitCodes() optionFunc {
+	return func(o *Cmd) error {
+		o.posixSignal = true
+		return nil
+	}
 }
 
-// handleTimeout if use commandContext timeout, can't match shell mode.
-func (c *Cmd) handleTimeout() {
-	if c.timeout <= 0 {
-		return
+// WithOutputCapacity pre-allocate n bytes for Output, Stdout and Stderr, reduce the reallocations
+// of the buffers for the command with the large known output
+func WithOutputCapacity(n int) optionFunc {
+	if n < 0 {
+		panic("output capacity >= 0")
 	}
 
-	call := func() {
-		select {
-		case <-c.doneChan:
-			// safe exit
+	return func(o *Cmd) error {
+		o.outputCap = n
+		return nil
+	}
+}
 
-		case <-c.ctx.Done():
-			if c.ctx.Err() == context.Canceled {
-				c.Status.Error = ErrProcessCancel
-			}
-			if c.ctx.Err() == context.DeadlineExceeded {
-				c.Status.Error = ErrProcessTimeout
+// WithExitCodeErrors set Status.Error to errs[code] when the command exits with the non-zero code,
+// it overrides the default mapping like 127 to ErrNotFoundCommand for this command only.
+// example: map the exit code 1 of grep to the not matched error of the app.
+func WithExitCodeErrors(errs map[int]error) optionFunc {
+	return func(o *Cmd) error {
+		o.exitCodeErrs = errs
+		return nil
+	}
+}
+
+// WithOOMDetection set Status.Error to ErrOOMKilled when the command is killed by the oom killer, linux only.
+// it's best-effort, the SIGKILL exit is checked against the oom_kill counter of /proc/vmstat read before start,
+// an oom kill of the other process in the meantime is a false positive. the counter needs the kernel 4.13+.
+func WithOOMDetection() optionFunc {
+	return func(o *Cmd) error {
+		o.oomDetect = true
+		return nil
+	}
+}
+
+// WithPTY attach the stdin, stdout and stderr of the command to a pseudo-terminal,
+// the output of the terminal is captured as stdout.
+func WithPTY() optionFunc {
+	return func(o *Cmd) error {
+		o.pty = true
+		return nil
+	}
+}
+
+// WithDetach run the command in a new session with stdio on /dev/null, it outlives the parent.
+// Start returns once the process is started, Wait returns immediately and Stop doesn't kill it.
+func WithDetach() optionFunc {
+	return func(o *Cmd) error {
+		o.detach = true
+		return nil
+	}
+}
+
+// WithExecMode set exec mode, example: ["curl", "-i", "-v", "xiaorui.cc"]
+func WithExecMode(b bool) optionFunc {
+	return func(o *Cmd) error {
+		o.ShellMode = false
+		return nil
+	}
+}
+
+// WithSetDir set work dir, the relative dir is resolved to absolute path against the current work dir
+func WithSetDir(dir string) optionFunc {
+	return func(o *Cmd) error {
+		if dir == "" {
+			o.Dir = dir
+			return nil
+		}
+
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return errors.Errorf("resolve dir %s failed, err: %s", dir, err.Error())
+		}
+		o.Dir = abs
+		o.Status.ResolvedDir = abs
+		return nil
+	}
+}
+
+// WithSetEnv set env
+func WithSetEnv(env []string) optionFunc {
+	return func(o *Cmd) error {
+		o.Env = env
+		return nil
+	}
+}
+
+// WithLogger set debug logger, default discard
+func WithLogger(l Logger) optionFunc {
+	return func(o *Cmd) error {
+		if l == nil {
+			l = nopLogger{}
+		}
+		o.logger = l
+		return nil
+	}
+}
+
+// WithName set a label of the command, it prefixes the logs and is shown in the CmdError message,
+// example: WithName("backup")
+func WithName(name string) optionFunc {
+	return func(o *Cmd) error {
+		o.name = name
+		return nil
+	}
+}
+
+// logf log with the name prefix
+func (c *Cmd) logf(format string, v ...interface{}) {
+	if c.name != "" {
+		format = "[" + c.name + "] " + format
+	}
+	c.logger.Printf(format, v...)
+}
+
+// WithStderrTail keep the last n bytes of stderr in the CmdError message, default 512.
+// Status.Stderr still has the whole stderr.
+func WithStderrTail(n int) optionFunc {
+	if n <= 0 {
+		panic("stderr tail > 0")
+	}
+
+	return func(o *Cmd) error {
+		o.stderrTail = n
+		return nil
+	}
+}
+
+// WithRedactEnv mask the values of the env keys in the logs, the command still gets the real values.
+// keys matching DefaultRedactEnvPattern are always masked.
+func WithRedactEnv(keys ...string) optionFunc {
+	return func(o *Cmd) error {
+		if o.redactEnv == nil {
+			o.redactEnv = make(map[string]bool, len(keys))
+		}
+		for _, key := range keys {
+			o.redactEnv[key] = true
+		}
+		return nil
+	}
+}
+
+// WithUmask set umask in the shell before the command runs, example: 0022. it only works in shell mode,
+// umask is a shell builtin, the exec mode command inherits the umask of the current process.
+func WithUmask(mask int) optionFunc {
+	if mask < 0 || mask > 0777 {
+		panic("umask range 0 - 0777")
+	}
+
+	return func(o *Cmd) error {
+		o.umask = mask
+		return nil
+	}
+}
+
+func newCommand(bash string) *Cmd {
+	return &Cmd{
+		Bash:       bash,
+		Status:     Status{},
+		ShellMode:  true,
+		umask:      -1,
+		logger:     nopLogger{},
+		shellFlag:  "-c",
+		statusChan: make(chan Status, 1),
+		doneChan:   make(chan error, 1),
+		exited:     make(chan struct{}),
+	}
+}
+
+// NewCommand create Cmd, option errors are ignored, use NewCommandE to catch them.
+func NewCommand(bash string, options ...optionFunc) *Cmd {
+	c := newCommand(bash)
+	for _, opt := range options {
+		opt(c)
+	}
+	return c
+}
+
+// NewCommandE create Cmd, return the first option error
+func NewCommandE(bash string, options ...optionFunc) (*Cmd, error) {
+	c := newCommand(bash)
+	for _, opt := range options {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Clone new Cmd with current config
+func (c *Cmd) Clone() *Cmd {
+	return NewCommand(c.Bash)
+}
+
+// AppendArgs append args to the command, the args are quoted in shell mode and
+// kept as argv in exec mode, so the spaces in args are preserved.
+func (c *Cmd) AppendArgs(args ...string) {
+	if len(args) == 0 {
+		return
+	}
+
+	if c.ShellMode {
+		c.Bash += " " + QuoteJoin(args...)
+		return
+	}
+
+	c.args = append(c.execArgs(), args...)
+	c.Bash += " " + strings.Join(args, " ")
+}
+
+func (c *Cmd) execArgs() []string {
+	if c.args != nil {
+		return c.args
+	}
+	return strings.Split(c.Bash, " ")
+}
+
+// Start async execute command
+func (c *Cmd) Start() error {
+	if c.Status.Finish {
+		return ErrAlreadyFinished
+	}
+
+	return c.run()
+}
+
+// Wait wait command finish
+func (c *Cmd) Wait() error {
+	<-c.doneChan
+	return c.Status.Error
+}
+
+// groupPollInterval poll the process group in WaitAll
+const groupPollInterval = 20 * time.Millisecond
+
+// WaitAll wait command finish, then wait the descendants in its process group exit in timeout,
+// return ErrProcessGroupAlive when some are still running. use it before cleaning up the shared resources.
+func (c *Cmd) WaitAll(timeout time.Duration) error {
+	<-c.doneChan
+	if c.stdcmd == nil || c.stdcmd.Process == nil || c.detach {
+		return c.Status.Error
+	}
+
+	pgid := c.stdcmd.Process.Pid
+	deadline := time.Now().Add(timeout)
+	for processGroupAlive(pgid) {
+		if time.Now().After(deadline) {
+			return ErrProcessGroupAlive
+		}
+		time.Sleep(groupPollInterval)
+	}
+	return c.Status.Error
+}
+
+// WaitStatus wait command finish, return a copy of the final status
+func (c *Cmd) WaitStatus() Status {
+	<-c.doneChan
+
+	c.Lock()
+	defer c.Unlock()
+	return c.Status
+}
+
+// TryWait return the final status and true if the command has finished, don't block
+func (c *Cmd) TryWait() (Status, bool) {
+	select {
+	case <-c.doneChan:
+	default:
+		return Status{}, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return c.Status, true
+}
+
+// WaitUntilReady poll probe every interval after Start until it returns true, stop the command and
+// return ErrNotReady on timeout. example probe: tcp dial the listen port of the background service.
+func (c *Cmd) WaitUntilReady(probe func() bool, interval, timeout time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		if probe() {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.doneChan:
+			return errors.Errorf("process exited before ready, exit code: %d", c.Status.ExitCode)
+		case <-timer.C:
+			c.Stop()
+			return ErrNotReady
+		}
+	}
+}
+
+// Run start and wait process exit
+func (c *Cmd) Run() error {
+	if c.retryAttempts > 1 {
+		return c.runRetry()
+	}
+
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+func (c *Cmd) buildCtx() {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.lifeCtx != nil && c.lifeCtx.Err() != nil {
+		c.lifeCtx = nil // the last run has exited, start a new lifetime
+	}
+	parent := c.lifetime()
+
+	if limit, ok := c.timeLimit(); ok {
+		c.ctx, c.cancel = context.WithTimeout(parent, limit)
+	} else {
+		c.ctx, c.cancel = context.WithCancel(parent)
+	}
+}
+
+// timeLimit the run time limit by WithTimeout and WithDeadline, the earlier one wins
+func (c *Cmd) timeLimit() (time.Duration, bool) {
+	var (
+		limit time.Duration
+		ok    bool
+	)
+	if c.timeout > 0 {
+		limit, ok = time.Duration(c.timeout)*time.Second, true
+	}
+	if !c.deadline.IsZero() {
+		if d := time.Until(c.deadline); !ok || d < limit {
+			limit, ok = d, true
+		}
+	}
+	return limit, ok
+}
+
+// lifetime build the lifetime context lazily, must hold the lock.
+func (c *Cmd) lifetime() context.Context {
+	if c.lifeCtx == nil {
+		c.lifeCtx, c.lifeCancel = context.WithCancel(context.Background())
+	}
+	return c.lifeCtx
+}
+
+// Context return the context of the command lifetime, it's done after the command exits and the output is
+// drained: finished, stopped or timed out. it's valid before Start, the retry attempts and Restart share it.
+func (c *Cmd) Context() context.Context {
+	c.Lock()
+	defer c.Unlock()
+	return c.lifetime()
+}
+
+func (c *Cmd) endLifetime() {
+	c.Lock()
+	defer c.Unlock()
+	if c.lifeCancel != nil {
+		c.lifeCancel()
+	}
+}
+
+func (c *Cmd) run() error {
+	var (
+		cmd *exec.Cmd
+
+		sysProcAttr *syscall.SysProcAttr
+	)
+
+	c.Lock()
+	canceled := c.cancelStart
+	c.Unlock()
+	if canceled {
+		c.logf("command is canceled before start")
+		c.setError(ErrProcessCancel)
+		c.runExitHooks()
+		return ErrProcessCancel
+	}
+
+	if !c.deadline.IsZero() && !time.Now().Before(c.deadline) {
+		c.logf("deadline %v has passed", c.deadline)
+		c.setError(ErrProcessTimeout)
+		c.runExitHooks()
+		return ErrProcessTimeout
+	}
+
+	if err := c.acquire(); err != nil {
+		c.setError(err)
+		c.runExitHooks()
+		return err
+	}
+
+	if c.lockPath != "" {
+		if err := c.lock(); err != nil {
+			c.logf("acquire lock file failed, err: %v", err)
+			c.setError(err)
+			c.runExitHooks()
+			return err
+		}
+	}
+
+	c.buildCtx()
+
+	sysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
+	c.Status.startTime = time.Now()
+	if c.oomDetect {
+		c.oomKills = oomKillCount()
+	}
+	if c.ShellMode {
+		shell, err := c.lookShell()
+		if err != nil {
+			c.logf("look shell failed, err: %v", err)
+			c.setError(err)
+			c.runExitHooks()
+			return err
+		}
+
+		cmd = exec.Command(shell, c.shellFlag, c.withUmask(c.withStrict(c.Bash)))
+	} else {
+		if c.umask >= 0 {
+			c.logf("umask is ignored in exec mode")
+		}
+
+		args := c.execArgs()
+		name := args[0]
+		if c.Env != nil {
+			// resolve the program in PATH of the command env
+			if path, err := lookPathEnv(name, c.Env); err == nil {
+				name = path
+			}
+		}
+		cmd = exec.Command(name, args[1:]...)
+		cmd.Args[0] = args[0]
+	}
+
+	for _, open := range c.openers {
+		if err := open(); err != nil {
+			err = errors.Errorf("open output file failed, err: %s", err.Error())
+			c.setError(err)
+			c.runExitHooks()
+			return err
+		}
+	}
+
+	cmd.Dir = c.Dir
+	cmd.Env = c.Env
+	cmd.Stdin = c.stdin
+	if c.inheritStdin {
+		cmd.Stdin = os.Stdin
+	}
+	if c.stdinFile != "" {
+		file, err := os.Open(c.stdinFile)
+		if err != nil {
+			err = errors.Errorf("open stdin file failed, err: %s", err.Error())
+			c.setError(err)
+			c.runExitHooks()
+			return err
+		}
+		if c.auditStdin {
+			c.stdinCloser = file // the audit tee reads it until the exit
+		} else {
+			defer file.Close() // the child has its own copy of the fd
+		}
+		cmd.Stdin = file
+	}
+	if c.auditStdin && cmd.Stdin != nil {
+		c.stdinAudit = &limitBuffer{limit: DefaultAuditStdinLimit}
+		cmd.Stdin = io.TeeReader(cmd.Stdin, c.stdinAudit)
+	}
+	cmd.ExtraFiles = c.extraFiles
+	cmd.SysProcAttr = sysProcAttr
+
+	if c.outputCap > 0 {
+		c.output.Lock()
+		c.output.buf.Grow(c.outputCap)
+		c.stdout.Grow(c.outputCap)
+		if !c.combined {
+			c.stderr.Grow(c.outputCap)
+		}
+		c.output.Unlock()
+	}
+
+	// merge multi writer, output is shared by the stdout and stderr copy goroutines.
+	stdoutWriters := append([]io.Writer{c.newCaptureWriter(&c.stdout, &c.stdoutCounter)}, c.stdoutWriters...)
+	stderrWriters := append([]io.Writer{c.newCaptureWriter(&c.stderr, &c.stderrCounter)}, c.stderrWriters...)
+	if c.idleTimeout > 0 {
+		idle := c.newIdleWriter()
+		stdoutWriters = append(stdoutWriters, idle)
+		stderrWriters = append(stderrWriters, idle)
+	}
+	var (
+		mergeStdout io.Writer = io.MultiWriter(stdoutWriters...)
+		mergeStderr io.Writer = io.MultiWriter(stderrWriters...)
+	)
+	if c.outputFilter != nil {
+		mergeStdout = c.newFilterWriter(mergeStdout)
+		mergeStderr = c.newFilterWriter(mergeStderr)
+	}
+	if c.encoding != nil {
+		mergeStdout = c.newDecoder(mergeStdout)
+		mergeStderr = c.newDecoder(mergeStderr)
+	}
+
+	// reset writer
+	cmd.Stdout = mergeStdout
+	cmd.Stderr = mergeStderr
+	if c.combined {
+		cmd.Stderr = mergeStdout // the same writer shares one pipe
+	}
+
+	var tty *ptyPair
+	if c.pty {
+		var err error
+		tty, err = c.attachPty(cmd)
+		if err != nil {
+			c.setError(err)
+			c.runExitHooks()
+			return err
+		}
+	}
+
+	if c.detach {
+		// nil stdio is /dev/null, a new session isn't in the process group of the parent
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, nil, nil
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	}
+
+	for _, hook := range c.cmdHooks {
+		hook(cmd)
+	}
+
+	// async start
+	c.logf("starting command: %q, dir: %q, env: %q", cmd.Args, cmd.Dir, c.redactedEnv(cmd.Env))
+	err := cmd.Start()
+
+	// publish after Start, Stop of the other goroutines reads the process in the lock
+	c.Lock()
+	c.stdcmd = cmd
+	canceled = c.cancelStart // canceled while starting, stop it below
+	c.Unlock()
+
+	if tty != nil {
+		tty.start(err, mergeStdout)
+	}
+	if err != nil {
+		c.logf("start command failed, err: %v", err)
+		c.closeStdin()
+		err = startError(err, cmd.Dir)
+		c.setError(err)
+		c.runExitHooks()
+		return err
+	}
+	c.logf("started command, pid: %d", cmd.Process.Pid)
+
+	if c.captureEnv {
+		env := cmd.Env
+		if env == nil {
+			env = os.Environ() // nil Env inherits the parent env
+		}
+		c.Status.Env = c.redactedEnv(env)
+	}
+
+	if c.pidFile != "" {
+		c.writePidFile()
+	}
+
+	if c.detach {
+		go cmd.Wait() // only reap the zombie, the process isn't tracked
+		c.finalizeDetached()
+		return nil
+	}
+
+	go c.handleWait()
+
+	if canceled {
+		c.Stop()
+	}
+	return nil
+}
+
+// redactedEnv copy env with the secret values masked
+func (c *Cmd) redactedEnv(env []string) []string {
+	out := make([]string, 0, len(env))
+	for _, kv := range env {
+		key := strings.SplitN(kv, "=", 2)[0]
+		if c.redactEnv[key] || DefaultRedactEnvPattern.MatchString(key) {
+			kv = key + "=***"
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+func (c *Cmd) writePidFile() {
+	pid := []byte(strconv.Itoa(c.stdcmd.Process.Pid))
+	err := ioutil.WriteFile(c.pidFile, pid, 0644)
+	if err == nil {
+		return
+	}
+
+	c.logf("write pid file failed, err: %v", err)
+	c.setError(errors.Errorf("write pid file failed, err: %s", err.Error()))
+	if c.pidFileKill {
+		c.Stop()
+	}
+}
+
+// lookShell find the shell in PATH, fallback bash to sh for the minimal containers
+func (c *Cmd) lookShell() (string, error) {
+	if c.shell != "" {
+		path, err := exec.LookPath(c.shell)
+		if err != nil {
+			return "", errors.Wrap(ErrShellNotFound, c.shell)
+		}
+		return path, nil
+	}
+
+	for _, shell := range []string{"bash", "sh"} {
+		if path, err := exec.LookPath(shell); err == nil {
+			return path, nil
+		}
+	}
+	return "", ErrShellNotFound
+}
+
+func (c *Cmd) withUmask(bash string) string {
+	if c.umask < 0 {
+		return bash
+	}
+	return fmt.Sprintf("umask %04o; %s", c.umask, bash)
+}
+
+func (c *Cmd) withStrict(bash string) string {
+	if !c.strict {
+		return bash
+	}
+	return "set -euo pipefail; " + bash
+}
+
+func (c *Cmd) handleWait() error {
+	defer func() {
+		// the timers write the status in the lock
+		c.Lock()
+		status := c.Status
+		c.Unlock()
+
+		if !status.Finish {
+			c.statusChan <- status
+			c.finalize()
+		}
+		c.runExitHooks()
+		close(c.exited)
+	}()
+
+	c.handleTimeout()
+
+	// join process
+	err := c.stdcmd.Wait()
+	if c.ptyDone != nil {
+		<-c.ptyDone
+	}
+	for i := len(c.flushers) - 1; i >= 0; i-- {
+		c.flushers[i]()
+	}
+	c.flushWriters()
+	c.closeStdin()
+	if c.stdinAudit != nil {
+		c.Lock()
+		if !c.isFinalized { // stopped, the status is final
+			c.Status.StdinCapture = c.stdinAudit.buf.String()
+		}
+		c.Unlock()
+	}
+
+	if c.ctx.Err() == context.DeadlineExceeded {
+		return err
+	}
+	if c.ctx.Err() == context.Canceled {
+		return err
+	}
+
+	if c.oomKilled() {
+		c.logf("process killed by the oom killer, pid: %d", c.stdcmd.Process.Pid)
+		c.setError(ErrOOMKilled)
+		return err
+	}
+	if err != nil {
+		c.setError(c.formatExitCode(err))
+		return err
+	}
+	return nil
+}
+
+// setError set Status.Error in the lock, the timers write it concurrently
+func (c *Cmd) setError(err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.Status.Error = err
+}
+
+// formatExitCode map the exit code with WithExitCodeErrors first, then the default sentinel errors
+func (c *Cmd) formatExitCode(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if mapped, ok := c.exitCodeErrs[exitErr.ExitCode()]; ok {
+			return mapped
+		}
+	}
+	return formatExitCode(err)
+}
+
+// oomKilled best-effort, the process is killed by SIGKILL which isn't sent by us, and the oom kill counter
+// of the system increased during the run. an oom kill of the other process in the meantime is a false positive.
+func (c *Cmd) oomKilled() bool {
+	if !c.oomDetect || c.oomKills < 0 || c.stdcmd.ProcessState == nil {
+		return false
+	}
+
+	c.Lock()
+	failed := c.Status.Error != nil // killed by the timers
+	c.Unlock()
+	if failed {
+		return false
+	}
+
+	ws, ok := c.stdcmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() || ws.Signal() != syscall.SIGKILL {
+		return false
+	}
+	return oomKillCount() > c.oomKills
+}
+
+func (c *Cmd) closeStdin() {
+	if c.stdinCloser != nil {
+		c.stdinCloser.Close()
+		c.stdinCloser = nil
+	}
+}
+
+// flushWriters flush the extra writers buffering the output, example: the gzip file, before the status is final
+func (c *Cmd) flushWriters() {
+	for _, w := range append(c.stdoutWriters, c.stderrWriters...) {
+		if f, ok := w.(interface{ Flush() error }); ok {
+			f.Flush()
+		}
+	}
+}
+
+// captureOutput set the output to status, Output, Stdout and Stderr are read in the same lock to keep them
+// consistent. it's called by finalize, must hold the lock. the output of the stopped command is captured so far.
+func (c *Cmd) captureOutput() {
+	c.output.Lock()
+	defer c.output.Unlock()
+
+	c.Status.Stdout = c.stdout.String()
+	c.Status.Stderr = c.stderr.String()
+	c.Status.Output = c.output.buf.String()
+	c.Status.StdoutBytes = c.stdoutCounter.Count()
+	c.Status.StderrBytes = c.stderrCounter.Count()
+}
+
+// Snapshot return a copy of stdout and stderr captured so far, it's safe to call while the command is running
+func (c *Cmd) Snapshot() (stdout, stderr string) {
+	c.output.Lock()
+	defer c.output.Unlock()
+	return c.stdout.String(), c.stderr.String()
+}
+
+func (c *Cmd) runExitHooks() {
+	if c.idle != nil {
+		c.idle.timer.Stop()
+	}
+	c.releaseSlot()
+	c.unlock()
+
+	c.Lock()
+	hold := c.holdExitHooks
+	c.Unlock()
+	if hold {
+		return
+	}
+
+	for _, hook := range c.exitHooks {
+		hook(c.Status)
+	}
+	c.endLifetime()
+}
+
+// handleTimeout if use commandContext timeout, can't match shell mode.
+func (c *Cmd) handleTimeout() {
+	limit, ok := c.timeLimit()
+	if !ok {
+		return
+	}
+
+	call := func() {
+		select {
+		case <-c.doneChan:
+			// safe exit
+
+		case <-c.ctx.Done():
+			c.Lock()
+			if c.ctx.Err() == context.Canceled {
+				c.Status.Error = ErrProcessCancel
+			}
+			if c.ctx.Err() == context.DeadlineExceeded {
+				c.Status.Error = ErrProcessTimeout
+			}
+			c.Unlock()
+
+			if c.ctx.Err() == context.DeadlineExceeded {
+				if c.timeoutDiag {
+					c.collectDiagnostics()
+				}
+				if c.timeoutGrace > 0 {
+					c.terminate(c.timeoutGrace)
+				}
+			}
+			c.Stop()
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.isFinalized {
+		return
+	}
+	c.timeoutTimer = time.AfterFunc(limit, call)
+}
+
+// terminate send SIGTERM to the process group, wait the exit in grace
+func (c *Cmd) terminate(grace time.Duration) {
+	cmd, _ := c.started()
+	pid := cmd.Process.Pid
+	c.logf("send signal %v to process group, pid: %d", syscall.SIGTERM, pid)
+	syscall.Kill(-pid, syscall.SIGTERM)
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-c.doneChan:
+	case <-timer.C:
+	}
+}
+
+// diagnosticsGrace wait the go child to dump the stacks after SIGQUIT
+const diagnosticsGrace = 200 * time.Millisecond
+
+func (c *Cmd) collectDiagnostics() {
+	cmd, _ := c.started()
+	pid := cmd.Process.Pid
+	diag := procDiagnostics(pid)
+	c.logf("timeout diagnostics, pid: %d\n%s", pid, diag)
+
+	// the process may exit on SIGQUIT and be finalized by the wait goroutine in the grace
+	c.Lock()
+	c.Status.Diagnostics = diag
+	c.Unlock()
+
+	syscall.Kill(-pid, syscall.SIGQUIT)
+	time.Sleep(diagnosticsGrace)
+}
+
+func (c *Cmd) newDecoder(w io.Writer) io.Writer {
+	dec := transform.NewWriter(w, c.encoding.NewDecoder())
+	c.flushers = append(c.flushers, func() {
+		dec.Close() // flush the incomplete bytes
+	})
+	return dec
+}
+
+// newFilterWriter write the lines transformed by outputFilter to w
+func (c *Cmd) newFilterWriter(w io.Writer) io.Writer {
+	final := false
+	lw := newLineWriter(func(line string) {
+		line = c.outputFilter(line)
+		if !final {
+			line += "\n"
+		}
+		w.Write([]byte(line))
+	})
+
+	c.flushers = append(c.flushers, func() {
+		// the last line has no newline
+		final = true
+		lw.Flush()
+	})
+	return lw
+}
+
+// idleWriter reset the idle timer on every write
+type idleWriter struct {
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (w *idleWriter) Write(p []byte) (int, error) {
+	w.timer.Reset(w.timeout)
+	return len(p), nil
+}
+
+func (c *Cmd) newIdleWriter() *idleWriter {
+	call := func() {
+		c.logf("no output for %v, idle timeout", c.idleTimeout)
+		c.setError(ErrIdleTimeout)
+		c.Stop()
+	}
+
+	w := &idleWriter{
+		timer:   time.AfterFunc(c.idleTimeout, call),
+		timeout: c.idleTimeout,
+	}
+	c.idle = w
+	return w
+}
+
+func (c *Cmd) finalize() {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.isFinalized {
+		return
+	}
+
+	if c.timeoutTimer != nil {
+		c.timeoutTimer.Stop()
+	}
+
+	c.captureOutput()
+	c.Status.CostTime = time.Now().Sub(c.Status.startTime)
+	c.Status.Finish = true
+	c.Status.PID = c.stdcmd.Process.Pid
+	c.Status.ExitCode = c.stdcmd.ProcessState.ExitCode()
+	if c.stdcmd.ProcessState != nil {
+		fillRusage(&c.Status, c.stdcmd.ProcessState)
+
+		ws, ok := c.stdcmd.ProcessState.Sys().(syscall.WaitStatus)
+		if c.posixSignal && ok && ws.Signaled() {
+			c.Status.ExitCode = 128 + int(ws.Signal())
+		}
+	}
+	if c.Status.Error != nil {
+		cmdErr := newCmdError(c.Bash, c.Status.ExitCode, c.Status.Stderr, c.Status.Error)
+		cmdErr.Name = c.name
+		if c.stderrTail > 0 {
+			cmdErr.Stderr = tailString(c.Status.Stderr, c.stderrTail)
+		}
+		c.Status.CmdError = cmdErr
+	}
+
+	if c.pidFile != "" {
+		os.Remove(c.pidFile)
+	}
+
+	c.logf("finalize command, pid: %d, exit code: %d, cost: %v", c.Status.PID, c.Status.ExitCode, c.Status.CostTime)
+
+	// notify
+	close(c.doneChan)
+	close(c.statusChan)
+	c.isFinalized = true
+}
+
+// reset clear the state of the last run, keep the config and the status fields set by the options
+func (c *Cmd) reset() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.stdcmd = nil
+	c.Status = Status{ResolvedDir: c.Status.ResolvedDir}
+	c.isFinalized = false
+	c.timeoutTimer = nil
+	c.flushers = nil
+	c.ptyDone = nil
+	c.idle = nil
+
+	c.output.Lock()
+	c.output.buf.Reset()
+	c.stdout.Reset()
+	c.stderr.Reset()
+	c.output.Unlock()
+	atomic.StoreInt64(&c.stdoutCounter.n, 0)
+	atomic.StoreInt64(&c.stderrCounter.n, 0)
+
+	c.statusChan = make(chan Status, 1)
+	c.doneChan = make(chan error, 1)
+	c.exited = make(chan struct{})
+}
+
+func (c *Cmd) finalizeDetached() {
+	c.Lock()
+	c.Status.Finish = true
+	c.Status.PID = c.stdcmd.Process.Pid
+	c.logf("detach command, pid: %d", c.Status.PID)
+
+	close(c.doneChan)
+	close(c.statusChan)
+	c.isFinalized = true
+	c.Unlock()
+
+	c.runExitHooks()
+}
+
+// started return the started exec.Cmd and the cancel of its run, the cmd is nil before Start
+func (c *Cmd) started() (*exec.Cmd, context.CancelFunc) {
+	c.Lock()
+	defer c.Unlock()
+	return c.stdcmd, c.cancel
+}
+
+// Stop kill -9 pid, the detached command isn't killed. it's safe to call from the other goroutines.
+func (c *Cmd) Stop() {
+	cmd, cancel := c.started()
+	if cmd == nil || cmd.Process == nil || c.detach {
+		return
+	}
+
+	c.logf("send signal %v to process group, pid: %d", syscall.SIGKILL, cmd.Process.Pid)
+	cancel()
+	c.finalize()
+	cmd.Process.Kill()
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// stopOrCancel stop the running command, the command which isn't started yet or is starting is canceled too,
+// its Start fails with ErrProcessCancel or the started process is stopped right away.
+func (c *Cmd) stopOrCancel() {
+	c.Lock()
+	c.cancelStart = true
+	c.Unlock()
+
+	c.Stop()
+}
+
+// defaultRestartGrace the SIGTERM grace of Restart without WithTimeoutGrace
+const defaultRestartGrace = 5 * time.Second
+
+// Restart stop the running command gracefully, SIGTERM the process group and SIGKILL it after the grace of
+// WithTimeoutGrace, default 5s. then start a new process with the same config, the exit hooks aren't called
+// for the stopped process.
+func (c *Cmd) Restart() error {
+	if c.detach {
+		return errors.New("detached command can't be restarted")
+	}
+	cmd, _ := c.started()
+	if cmd == nil {
+		return c.Start()
+	}
+
+	if cmd.Process != nil {
+		c.Lock()
+		c.holdExitHooks = true
+		c.Unlock()
+
+		select {
+		case <-c.exited:
+		default:
+			grace := c.timeoutGrace
+			if grace <= 0 {
+				grace = defaultRestartGrace
+			}
+			c.logf("restart command, pid: %d", cmd.Process.Pid)
+			c.terminate(grace)
+			c.Stop()
+			<-c.exited
+		}
+
+		c.Lock()
+		c.holdExitHooks = false
+		c.Unlock()
+	}
+
+	c.reset()
+	return c.Start()
+}
+
+// Close release the resources of the command, stop the process if it's still running,
+// cancel the context and stop the timers. it's idempotent, use it via defer after Start.
+func (c *Cmd) Close() error {
+	if c.stdcmd == nil || c.stdcmd.Process == nil {
+		return nil
+	}
+
+	c.Lock()
+	finalized := c.isFinalized
+	c.Unlock()
+
+	if finalized {
+		c.cancel()
+		return nil
+	}
+
+	c.Stop()
+	return nil
+}
+
+// Kill send custom signal to process
+func (c *Cmd) Kill(sig syscall.Signal) {
+	c.logf("send signal %v to process, pid: %d", sig, c.stdcmd.Process.Pid)
+	syscall.Kill(c.stdcmd.Process.Pid, sig)
+}
+
+// Cost
+func (c *Cmd) Cost() time.Duration {
+	return c.Status.CostTime
+}
+
+func formatExitCode(err error) error {
+	if err == nil {
+		return err
+	}
+
+	if strings.Contains(err.Error(), "exit status 127") {
+		return ErrNotFoundCommand
+	}
+	if strings.Contains(err.Error(), "exit status 126") {
+		return ErrNotExecutePermission
+	}
+	if strings.Contains(err.Error(), "exit status 128") {
+		return ErrInvalidArgs
+	}
+
+	return err
+}
+
+// startError map the pre-exec failure of the program to the sentinel errors like the shell exit codes
+// 127 and 126, the original error is kept in the message
+func startError(err error, dir string) error {
+	if pe, ok := err.(*os.PathError); ok && pe.Op != "fork/exec" {
+		return err // not the program, example: chdir to the missing work dir
+	}
+	if _, serr := os.Stat(dir); dir != "" && serr != nil {
+		return err // the chdir failure of the child is reported as fork/exec too
+	}
+
+	switch {
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return errors.Wrap(ErrNotFoundCommand, err.Error())
+	case errors.Is(err, os.ErrPermission):
+		return errors.Wrap(ErrNotExecutePermission, err.Error())
+	}
+	return err
+}
+
+// CheckCmdExists check command in the PATH
+func CheckCmdExists(cmd string) bool {
+	_, err := exec.LookPath(cmd)
+	if err != nil {
+		return false
+	} else {
+		return true
+	}
+}
+
+// CheckCmdVersion run `cmd versionArg`, extract the version with the first capture group of pattern,
+// return whether the version >= min. example: CheckCmdVersion("git", "--version", `(\d+\.\d+\.\d+)`, "2.0")
+func CheckCmdVersion(cmd, versionArg, pattern string, min string) (bool, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, errors.Errorf("invalid version pattern, err: %s", err.Error())
+	}
+
+	outbs, err := exec.Command(cmd, versionArg).CombinedOutput()
+	if err != nil {
+		return false, errors.Errorf("get %s version failed, err: %s", cmd, err.Error())
+	}
+
+	match := re.FindStringSubmatch(string(outbs))
+	if match == nil {
+		return false, errors.Errorf("version not found in output: %q", string(outbs))
+	}
+
+	version := match[0]
+	if len(match) > 1 {
+		version = match[1]
+	}
+	return compareVersion(version, min) >= 0, nil
+}
+
+// CheckPnameRunning easy method
+func CheckPnameRunning(pname string) bool {
+	out, _, _ := CommandFormat("ps aux | grep %s |grep -v grep", pname)
+	if strings.Contains(out, pname) {
+		return true
+	}
+	return false
+}
+
+// Command easy command, return CombinedOutput, exitcode, err
+func Command(args string) (string, int, error) {
+	cmd := exec.Command("bash", "-c", args)
+	outbs, err := cmd.CombinedOutput()
+	out := string(outbs)
+	return out, cmd.ProcessState.ExitCode(), err
+}
+
+// CommandLine easy command, return the output trimmed of the surrounding spaces and newlines, exitcode, err.
+// example: CommandLine("hostname")
+func CommandLine(args string) (string, int, error) {
+	out, code, err := Command(args)
+	return strings.TrimSpace(out), code, err
+}
+
+// CommandLines easy command, return the output split into lines without the trailing empty line, exitcode, err.
+// example: CommandLines("ls /etc")
+func CommandLines(args string) ([]string, int, error) {
+	out, code, err := Command(args)
+	out = strings.TrimSuffix(out, "\n")
+	if out == "" {
+		return nil, code, err
+	}
+	return strings.Split(out, "\n"), code, err
+}
+
+// CommandExpect run the command, return an error describing the first different line when the trimmed
+// output isn't equal to expected. the exit code is ignored, useful in the smoke tests.
+func CommandExpect(args, expected string) error {
+	out, _, _ := Command(args)
+	out = strings.TrimSpace(out)
+	if out == expected {
+		return nil
+	}
+
+	outLines, expectedLines := strings.Split(out, "\n"), strings.Split(expected, "\n")
+	for i := 0; ; i++ {
+		var got, want string
+		if i < len(outLines) {
+			got = outLines[i]
+		}
+		if i < len(expectedLines) {
+			want = expectedLines[i]
+		}
+		if got != want || i >= len(outLines) || i >= len(expectedLines) {
+			return errors.Errorf("output mismatch at line %d, expected: %q, got: %q, output: %q", i+1, want, got, out)
+		}
+	}
+}
+
+// CommandTable run the columnar output command, example: df, ps. split every non-empty line into fields
+// on whitespace, return the rows and the header if hasHeader. the rows keep their own length.
+func CommandTable(args string, hasHeader bool) ([][]string, []string, error) {
+	return CommandTableFunc(args, hasHeader, strings.Fields)
+}
+
+// CommandTableFunc like CommandTable, split the lines with split, example: func(l string) []string { return strings.Split(l, ",") }
+func CommandTableFunc(args string, hasHeader bool, split func(line string) []string) ([][]string, []string, error) {
+	out, _, err := Command(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, header := parseTable(out, hasHeader, split)
+	return rows, header, nil
+}
+
+func parseTable(out string, hasHeader bool, split func(line string) []string) ([][]string, []string) {
+	var (
+		header []string
+		rows   [][]string
+	)
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		fields := split(strings.TrimRight(line, " \t\r"))
+		if hasHeader && header == nil {
+			header = fields
+			continue
+		}
+		rows = append(rows, fields)
+	}
+	return rows, header
+}
+
+// CommandContext easy command, return CombinedOutput, exitcode, err.
+// the process group is killed when ctx is done.
+func CommandContext(ctx context.Context, args string) (string, int, error) {
+	return runContext(ctx, args)
+}
+
+// CommandClean easy command with exactly the env, the parent env isn't inherited.
+// example: CommandClean("make", "PATH=/usr/bin:/bin", "LANG=C")
+func CommandClean(args string, env ...string) (string, int, error) {
+	cmd := exec.Command("bash", "-c", args)
+	cmd.Env = append([]string{}, env...) // nil Env inherits the parent env
+	outbs, err := cmd.CombinedOutput()
+	out := string(outbs)
+	return out, cmd.ProcessState.ExitCode(), err
+}
+
+// CommandAll run cmds in order, stop at the first failure. return the outputs of the ran commands,
+// the index of the failed command and its error, failedIndex is -1 when all succeed.
+func CommandAll(cmds ...string) (outputs []string, failedIndex int, err error) {
+	outputs = make([]string, 0, len(cmds))
+	for i, cmd := range cmds {
+		out, code, err := Command(cmd)
+		outputs = append(outputs, out)
+		if err != nil || code != 0 {
+			if err == nil {
+				err = errors.Errorf("exit code: %d", code)
+			}
+			return outputs, i, err
+		}
+	}
+	return outputs, -1, nil
+}
+
+// CommandIf run action only if condition exits 0, return the result of action. return the exitcode of
+// condition and ErrCommandSkipped when it exits non-zero. example: CommandIf("! command -v jq", "yum install -y jq")
+func CommandIf(condition, action string) (string, int, error) {
+	_, code, err := Command(condition)
+	if code != 0 {
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			return "", code, err // condition failed to run
+		}
+		return "", code, ErrCommandSkipped
+	}
+	return Command(action)
+}
+
+// CommandSession run cmds in one bash process joined by newlines, the variables and the work dir are shared
+// between them. return CombinedOutput, exitcode of the last command, err
+func CommandSession(cmds ...string) (string, int, error) {
+	return Command(strings.Join(cmds, "\n"))
+}
+
+// CommandSessionStrict like CommandSession, run with `set -e`, the session exits at the first failure
+func CommandSessionStrict(cmds ...string) (string, int, error) {
+	return Command("set -e\n" + strings.Join(cmds, "\n"))
+}
+
+// Command easy command format, return CombinedOutput, exitcode, err
+func CommandFormat(format string, vals ...interface{}) (string, int, error) {
+	sh := fmt.Sprintf(format, vals...)
+	return Command(sh)
+}
+
+// CommandFormatContext easy command format with ctx, return CombinedOutput, exitcode, err
+func CommandFormatContext(ctx context.Context, format string, vals ...interface{}) (string, int, error) {
+	return runContext(ctx, fmt.Sprintf(format, vals...))
+}
+
+// CommandSafe run name with args directly without shell, the args are never interpreted by a shell.
+// return CombinedOutput, exitcode, err
+func CommandSafe(name string, args ...string) (string, int, error) {
+	cmd := exec.Command(name, args...)
+	outbs, err := cmd.CombinedOutput()
+	if err != nil && cmd.ProcessState == nil {
+		return string(outbs), DefaultExitCode, err
+	}
+	return string(outbs), cmd.ProcessState.ExitCode(), err
+}
+
+// CommandContains easy command, then match output with multi substr
+func CommandContains(args string, subs ...string) bool {
+	outbs, _, err := Command(args)
+	if err != nil {
+		return false
+	}
+	return containsAll(outbs, subs...)
+}
+
+// CommandContainsContext easy command with ctx, then match output with multi substr, false when ctx is done
+func CommandContainsContext(ctx context.Context, args string, subs ...string) bool {
+	out, _, err := runContext(ctx, args)
+	if err != nil {
+		return false
+	}
+	return containsAll(out, subs...)
+}
+
+func containsAll(out string, subs ...string) bool {
+	for _, sub := range subs {
+		if !strings.Contains(out, sub) {
+			return false
+		}
+	}
+	return true
+}
+
+// CommandScript write script to random fname in /tmp directory and bash execute
+func CommandScript(script []byte) (string, int, error) {
+	return CommandScriptContext(context.Background(), script)
+}
+
+// CommandScriptContext write script to random fname in /tmp directory and bash execute,
+// the process group is killed when ctx is done.
+func CommandScriptContext(ctx context.Context, script []byte) (string, int, error) {
+	fpath := fmt.Sprintf("/tmp/go-shell-%s", randString(16))
+	defer os.Remove(fpath) // also the partial file of the failed write and the script of the failed start
+
+	err := ioutil.WriteFile(fpath, script, 0666)
+	if err != nil {
+		return "", DefaultExitCode, errors.Errorf("dump script to file failed, err: %s", err.Error())
+	}
+
+	return runContext(ctx, fmt.Sprintf("bash %s", fpath))
+}
+
+// runContext run bash in a new process group, return CombinedOutput, exitcode, err.
+// the process group is killed when ctx is done.
+func runContext(ctx context.Context, bash string) (string, int, error) {
+	var output bytes.Buffer
+
+	cmd := exec.Command("bash", "-c", bash)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Start()
+	if err != nil {
+		return "", DefaultExitCode, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		err = contextError(ctx)
+	}
+	return output.String(), cmd.ProcessState.ExitCode(), err
+}
+
+// contextError convert the error of done ctx to ErrProcessTimeout or ErrProcessCancel
+func contextError(ctx context.Context) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return ErrProcessTimeout
+	case context.Canceled:
+		return ErrProcessCancel
+	}
+	return nil
+}
+
+// CommandWithMultiOut run command and return multi result; return string(stdout), string(stderr), exidcode, err
+func CommandWithMultiOut(cmd string) (string, string, int, error) {
+	var (
+		stdout, stderr bytes.Buffer
+		err            error
+	)
+
+	runner := exec.Command("bash", "-c", cmd)
+	runner.Stdout = &stdout
+	runner.Stderr = &stderr
+	err = runner.Start()
+	if err != nil {
+		return string(stdout.Bytes()), string(stderr.Bytes()), runner.ProcessState.ExitCode(), err
+	}
+
+	err = runner.Wait()
+	return string(stdout.Bytes()), string(stderr.Bytes()), runner.ProcessState.ExitCode(), err
+}
+
+// CommandWithChan return result queue
+func CommandWithChan(cmd string, queue chan string) error {
+	runner := exec.Command("bash", "-c", cmd)
+	stdout, err := runner.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	stderr, err := runner.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	runner.Start()
+
+	call := func(in io.ReadCloser) {
+		reader := bufio.NewReader(in)
+		for {
+			line, _, err := reader.ReadLine()
+			if err != nil || io.EOF == err {
+				break
+			}
+
+			select {
+			case queue <- string(line):
+			default:
+			}
+		}
+	}
+
+	go call(stdout)
+	go call(stderr)
+
+	runner.Wait()
+	close(queue)
+	return nil
+}
+
+// CommandWithChanSized send the output lines to queue like CommandWithChan, a line is up to maxLine bytes.
+// the sends block until the line is consumed, return ErrLineBufferOverflow when a line exceeds maxLine,
+// the rest of the output is discarded then. queue is closed when the command exits.
+func CommandWithChanSized(cmd string, queue chan string, maxLine int) error {
+	defer close(queue)
+
+	runner := exec.Command("bash", "-c", cmd)
+	stdout, err := runner.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	stderr, err := runner.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	err = runner.Start()
+	if err != nil {
+		return err
+	}
+
+	var overflow int32
+	call := func(in io.ReadCloser) {
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 0, 4096), maxLine)
+		for scanner.Scan() {
+			queue <- scanner.Text()
+		}
+		if scanner.Err() == bufio.ErrTooLong {
+			atomic.StoreInt32(&overflow, 1)
+		}
+		io.Copy(ioutil.Discard, in) // don't block the writer of the pipe
+	}
+
+	// read all the output before Wait, Wait closes the pipes.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		call(stdout)
+	}()
+	go func() {
+		defer wg.Done()
+		call(stderr)
+	}()
+	wg.Wait()
+
+	runner.Wait()
+	if atomic.LoadInt32(&overflow) == 1 {
+		return ErrLineBufferOverflow
+	}
+	return nil
+}
+
+// CommandWithChans send the stdout lines to stdoutCh and the stderr lines to stderrCh, close both when the
+// command exits. the sends block until the line is consumed, return exitcode, err
+func CommandWithChans(cmd string, stdoutCh, stderrCh chan string) (int, error) {
+	defer close(stdoutCh)
+	defer close(stderrCh)
+
+	runner := exec.Command("bash", "-c", cmd)
+	stdout, err := runner.StdoutPipe()
+	if err != nil {
+		return DefaultExitCode, err
+	}
+
+	stderr, err := runner.StderrPipe()
+	if err != nil {
+		return DefaultExitCode, err
+	}
+
+	err = runner.Start()
+	if err != nil {
+		return DefaultExitCode, err
+	}
+
+	call := func(in io.ReadCloser, queue chan string) {
+		reader := bufio.NewReader(in)
+		for {
+			line, _, err := reader.ReadLine()
+			if err != nil {
+				return
 			}
-			c.Stop()
+			queue <- string(line)
 		}
 	}
 
-	time.AfterFunc(time.Duration(c.timeout)*time.Second, call)
-}
-
-func (c *Cmd) finalize() {
-	c.Lock()
-	defer c.Unlock()
-
-	if c.isFinalized {
-		return
-	}
-
-	c.Status.CostTime = time.Now().Sub(c.Status.startTime)
-	c.Status.Finish = true
-	c.Status.PID = c.stdcmd.Process.Pid
-	c.Status.ExitCode = c.stdcmd.ProcessState.ExitCode()
+	// read all the output before Wait, Wait closes the pipes.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		call(stdout, stdoutCh)
+	}()
+	go func() {
+		defer wg.Done()
+		call(stderr, stderrCh)
+	}()
+	wg.Wait()
 
-	// notify
-	close(c.doneChan)
-	close(c.statusChan)
-	c.isFinalized = true
+	err = runner.Wait()
+	return runner.ProcessState.ExitCode(), err
 }
 
-// Stop kill -9 pid
-func (c *Cmd) Stop() {
-	if c.stdcmd == nil || c.stdcmd.Process == nil {
-		return
-	}
+// syncBuffer serialize writes from concurrent writers, each Write is appended as a whole.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
 
-	c.cancel()
-	c.finalize()
-	c.stdcmd.Process.Kill()
-	syscall.Kill(-c.stdcmd.Process.Pid, syscall.SIGKILL)
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.Lock()
+	defer sb.Unlock()
+	return sb.buf.Write(p)
 }
 
-// Kill send custom signal to process
-func (c *Cmd) Kill(sig syscall.Signal) {
-	syscall.Kill(c.stdcmd.Process.Pid, sig)
+func (sb *syncBuffer) String() string {
+	sb.Lock()
+	defer sb.Unlock()
+	return sb.buf.String()
 }
 
-// Cost
-func (c *Cmd) Cost() time.Duration {
-	return c.Status.CostTime
+// captureWriter append the writes of one fd to its own buffer and the combined output in the lock of output,
+// Output is always the interleaving of the whole writes of Stdout and Stderr.
+type captureWriter struct {
+	output  *syncBuffer
+	own     *bytes.Buffer
+	counter *countWriter
 }
 
-func formatExitCode(err error) error {
-	if err == nil {
-		return err
+func (c *Cmd) newCaptureWriter(own *bytes.Buffer, counter *countWriter) *captureWriter {
+	return &captureWriter{
+		output:  &c.output,
+		own:     own,
+		counter: counter,
 	}
+}
 
-	if strings.Contains(err.Error(), "exit status 127") {
-		return ErrNotFoundCommand
-	}
-	if strings.Contains(err.Error(), "exit status 126") {
-		return ErrNotExecutePermission
-	}
-	if strings.Contains(err.Error(), "exit status 128") {
-		return ErrInvalidArgs
-	}
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.output.Lock()
+	defer w.output.Unlock()
 
-	return err
+	w.output.buf.Write(p)
+	w.own.Write(p)
+	return w.counter.Write(p)
 }
 
-// CheckCmdExists check command in the PATH
-func CheckCmdExists(cmd string) bool {
-	_, err := exec.LookPath(cmd)
-	if err != nil {
-		return false
-	} else {
-		return true
-	}
+// limitBuffer keep the first limit bytes, the rest is discarded without error
+type limitBuffer struct {
+	buf   bytes.Buffer
+	limit int
 }
 
-// CheckPnameRunning easy method
-func CheckPnameRunning(pname string) bool {
-	out, _, _ := CommandFormat("ps aux | grep %s |grep -v grep", pname)
-	if strings.Contains(out, pname) {
-		return true
+func (lb *limitBuffer) Write(p []byte) (int, error) {
+	if free := lb.limit - lb.buf.Len(); free > 0 {
+		if len(p) > free {
+			lb.buf.Write(p[:free])
+		} else {
+			lb.buf.Write(p)
+		}
 	}
-	return false
+	return len(p), nil
 }
 
-// Command easy command, return CombinedOutput, exitcode, err
-func Command(args string) (string, int, error) {
-	cmd := exec.Command("bash", "-c", args)
-	outbs, err := cmd.CombinedOutput()
-	out := string(outbs)
-	return out, cmd.ProcessState.ExitCode(), err
+// countWriter count the written bytes and discard them.
+type countWriter struct {
+	n int64
 }
 
-// Command easy command format, return CombinedOutput, exitcode, err
-func CommandFormat(format string, vals ...interface{}) (string, int, error) {
-	sh := fmt.Sprintf(format, vals...)
-	return Command(sh)
+func (cw *countWriter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&cw.n, int64(len(p)))
+	return len(p), nil
 }
 
-// CommandContains easy command, then match output with multi substr
-func CommandContains(args string, subs ...string) bool {
-	outbs, _, err := Command(args)
-	if err != nil {
-		return false
-	}
+func (cw *countWriter) Count() int64 {
+	return atomic.LoadInt64(&cw.n)
+}
 
-	out := string(outbs)
-	for _, sub := range subs {
-		if !strings.Contains(out, sub) {
-			return false
-		}
-	}
-	return true
+// lineWriter split the written bytes into lines, call fn with each line without the trailing newline.
+type lineWriter struct {
+	fn  func(line string)
+	buf []byte
 }
 
-// CommandScript write script to random fname in /tmp directory and bash execute
-func CommandScript(script []byte) (string, int, error) {
-	fpath := fmt.Sprintf("/tmp/go-shell-%s", randString(16))
-	defer os.RemoveAll(fpath)
+func newLineWriter(fn func(line string)) *lineWriter {
+	return &lineWriter{fn: fn}
+}
 
-	err := ioutil.WriteFile(fpath, script, 0666)
-	if err != nil {
-		return "", DefaultExitCode, errors.Errorf("dump script to file failed, err: %s", err.Error())
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+
+	start := 0
+	for {
+		offset := bytes.IndexByte(lw.buf[start:], '\n')
+		if offset < 0 {
+			break
+		}
+		line := bytes.TrimSuffix(lw.buf[start:start+offset], []byte{'\r'})
+		lw.fn(string(line))
+		start += offset + 1
 	}
 
-	out, code, err := CommandFormat("bash %s", fpath)
-	return out, code, err
+	// keep the incomplete line
+	lw.buf = append(lw.buf[:0], lw.buf[start:]...)
+	return len(p), nil
 }
 
-// CommandWithMultiOut run command and return multi result; return string(stdout), string(stderr), exidcode, err
-func CommandWithMultiOut(cmd string) (string, string, int, error) {
-	var (
-		stdout, stderr bytes.Buffer
-		err            error
-	)
-
-	runner := exec.Command("bash", "-c", cmd)
-	runner.Stdout = &stdout
-	runner.Stderr = &stderr
-	err = runner.Start()
-	if err != nil {
-		return string(stdout.Bytes()), string(stderr.Bytes()), runner.ProcessState.ExitCode(), err
+// Flush call fn with the remaining incomplete line.
+func (lw *lineWriter) Flush() {
+	if len(lw.buf) == 0 {
+		return
 	}
-
-	err = runner.Wait()
-	return string(stdout.Bytes()), string(stderr.Bytes()), runner.ProcessState.ExitCode(), err
+	lw.fn(string(lw.buf))
+	lw.buf = lw.buf[:0]
 }
 
-// CommandWithChan return result queue
-func CommandWithChan(cmd string, queue chan string) error {
+// CommandWithChanContext send the output lines to queue, close queue when the command exits.
+// the sends block until the line is consumed, the process group is killed when ctx is done,
+// so an abandoned consumer can cancel ctx to release the command.
+func CommandWithChanContext(ctx context.Context, cmd string, queue chan string) error {
 	runner := exec.Command("bash", "-c", cmd)
+	runner.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	stdout, err := runner.StdoutPipe()
 	if err != nil {
 		return err
@@ -421,34 +2231,59 @@ func CommandWithChan(cmd string, queue chan string) error {
 		return err
 	}
 
-	runner.Start()
+	err = runner.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-runner.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
 
 	call := func(in io.ReadCloser) {
 		reader := bufio.NewReader(in)
 		for {
 			line, _, err := reader.ReadLine()
-			if err != nil || io.EOF == err {
-				break
+			if err != nil {
+				return
 			}
 
 			select {
 			case queue <- string(line):
-			default:
+			case <-ctx.Done():
+				return
 			}
 		}
 	}
 
-	go call(stdout)
-	go call(stderr)
+	// read all the output before Wait, Wait closes the pipes.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		call(stdout)
+	}()
+	go func() {
+		defer wg.Done()
+		call(stderr)
+	}()
+	wg.Wait()
 
 	runner.Wait()
 	close(queue)
-	return nil
+	return contextError(ctx)
 }
 
 type OutputBuffer struct {
-	buf   *bytes.Buffer
-	lines []string
+	buf      *bytes.Buffer
+	lines    []string
+	maxLines int // 0 is unlimited
 	*sync.Mutex
 }
 
@@ -461,19 +2296,55 @@ func NewOutputBuffer() *OutputBuffer {
 	return out
 }
 
+// NewOutputBufferLimit keep only the last maxLines lines, the oldest lines are dropped.
+func NewOutputBufferLimit(maxLines int) *OutputBuffer {
+	if maxLines <= 0 {
+		panic("maxLines > 0")
+	}
+
+	out := NewOutputBuffer()
+	out.maxLines = maxLines
+	return out
+}
+
 func (rw *OutputBuffer) Write(p []byte) (n int, err error) {
 	rw.Lock()
 	n, err = rw.buf.Write(p) // and bytes.Buffer implements io.Writer
+	if rw.maxLines > 0 {
+		rw.drainLines()
+	}
 	rw.Unlock()
 	return
 }
 
+// drainLines move the complete lines from buf to the bounded lines, must hold the lock.
+func (rw *OutputBuffer) drainLines() {
+	for {
+		offset := bytes.IndexByte(rw.buf.Bytes(), '\n')
+		if offset < 0 {
+			break
+		}
+		line := rw.buf.Next(offset + 1)
+		rw.lines = append(rw.lines, string(bytes.TrimSuffix(line[:offset], []byte{'\r'})))
+	}
+	rw.trimLines()
+}
+
+func (rw *OutputBuffer) trimLines() {
+	if rw.maxLines <= 0 || len(rw.lines) <= rw.maxLines {
+		return
+	}
+	// copy to release the dropped lines
+	rw.lines = append([]string{}, rw.lines[len(rw.lines)-rw.maxLines:]...)
+}
+
 func (rw *OutputBuffer) Lines() []string {
 	rw.Lock()
 	s := bufio.NewScanner(rw.buf)
 	for s.Scan() {
 		rw.lines = append(rw.lines, s.Text())
 	}
+	rw.trimLines()
 	rw.Unlock()
 	return rw.lines
 }
@@ -481,18 +2352,70 @@ func (rw *OutputBuffer) Lines() []string {
 type OutputStream struct {
 	streamChan chan string
 	bufSize    int
+	maxBufSize int // the buffer doubles up to it for the long line, enabled by WithGrowableLineBuffer
 	buf        []byte
 	lastChar   int
+
+	// bounded queue between Write and streamChan, enabled by SetHighWaterMark
+	pending   chan string
+	stop      chan struct{} // closed by finish, the forwarder delivers the queued lines then exits
+	forwarded chan struct{} // closed when the forwarder exits
+	dropped   int64
+
+	closeOnce  sync.Once
+	finishOnce sync.Once
+
+	// pace of the lines, enabled by WithRateLimit
+	paceMu   sync.Mutex // the stdout and stderr writers may share the stream
+	interval time.Duration
+	next     time.Time
+	dropRate bool
+}
+
+// streamOption option of NewOutputStream
+type streamOption func(*OutputStream) error
+
+// WithRateLimit deliver up to linesPerSecond lines to the channel, Write waits for the pace of the excess
+// lines, the process is slowed down by the full pipe. see WithRateLimitDrop.
+func WithRateLimit(linesPerSecond int) streamOption {
+	if linesPerSecond <= 0 {
+		panic("lines per second > 0")
+	}
+
+	return func(rw *OutputStream) error {
+		rw.interval = time.Second / time.Duration(linesPerSecond)
+		return nil
+	}
+}
+
+// WithRateLimitDrop drop the excess lines of WithRateLimit instead of waiting, they're counted by Dropped
+func WithRateLimitDrop() streamOption {
+	return func(rw *OutputStream) error {
+		rw.dropRate = true
+		return nil
+	}
+}
+
+// WithGrowableLineBuffer double the line buffer up to DefaultMaxLineBufferSize for the line longer than
+// the buffer, example: the long json logs. Write returns ErrLineBufferOverflow only when a line exceeds it.
+func WithGrowableLineBuffer() streamOption {
+	return func(rw *OutputStream) error {
+		rw.maxBufSize = DefaultMaxLineBufferSize
+		return nil
+	}
 }
 
 // NewOutputStream creates a new streaming output on the given channel.
-func NewOutputStream(streamChan chan string) *OutputStream {
+func NewOutputStream(streamChan chan string, options ...streamOption) *OutputStream {
 	out := &OutputStream{
 		streamChan: streamChan,
 		bufSize:    16384,
 		buf:        make([]byte, 16384),
 		lastChar:   0,
 	}
+	for _, opt := range options {
+		opt(out)
+	}
 	return out
 }
 
@@ -521,7 +2444,7 @@ func (rw *OutputStream) Write(p []byte) (n int, err error) {
 			rw.lastChar = 0 // reset buffer
 		}
 		line += string(p[firstChar:lastChar])
-		rw.streamChan <- line // blocks if chan full
+		rw.send(line)
 
 		// Next line offset is the first byte (+1) after the newline (i)
 		firstChar += newlineOffset + 1
@@ -530,6 +2453,10 @@ func (rw *OutputStream) Write(p []byte) (n int, err error) {
 	if firstChar < n {
 		remain := len(p[firstChar:])
 		bufFree := len(rw.buf[rw.lastChar:])
+		if remain > bufFree && rw.maxBufSize > 0 {
+			rw.growBuffer(rw.lastChar + remain)
+			bufFree = len(rw.buf[rw.lastChar:])
+		}
 		if remain > bufFree {
 			var line string
 			if rw.lastChar > 0 {
@@ -555,3 +2482,218 @@ func (rw *OutputStream) SetLineBufferSize(n int) {
 	rw.bufSize = n
 	rw.buf = make([]byte, rw.bufSize)
 }
+
+// growBuffer double the buffer until it holds size bytes, the incomplete line is kept
+func (rw *OutputStream) growBuffer(size int) {
+	newSize := rw.bufSize
+	for newSize < size && newSize < rw.maxBufSize {
+		newSize *= 2
+	}
+	if newSize > rw.maxBufSize {
+		newSize = rw.maxBufSize
+	}
+	if newSize <= rw.bufSize {
+		return
+	}
+
+	buf := make([]byte, newSize)
+	copy(buf, rw.buf[:rw.lastChar])
+	rw.buf = buf
+	rw.bufSize = newSize
+}
+
+// SetHighWaterMark queue up to n lines for a lagging consumer instead of blocking Write,
+// the lines beyond the mark are dropped and counted by Dropped. call it before the first
+// Write, and Close to stop the forwarder when the stream is done.
+func (rw *OutputStream) SetHighWaterMark(n int) {
+	if n <= 0 {
+		panic("high water mark > 0")
+	}
+
+	rw.pending = make(chan string, n)
+	rw.stop = make(chan struct{})
+	rw.forwarded = make(chan struct{})
+	go rw.forward()
+}
+
+// forward deliver the queued lines to streamChan until pending is closed or stop
+func (rw *OutputStream) forward() {
+	defer close(rw.forwarded)
+
+	for {
+		select {
+		case line, ok := <-rw.pending:
+			if !ok {
+				return
+			}
+			rw.streamChan <- line
+
+		case <-rw.stop:
+			for {
+				select {
+				case line, ok := <-rw.pending:
+					if !ok {
+						return
+					}
+					rw.streamChan <- line
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// pace wait the turn of the next line, return false if the line is dropped
+func (rw *OutputStream) pace() bool {
+	rw.paceMu.Lock()
+	defer rw.paceMu.Unlock()
+
+	now := time.Now()
+	if now.Before(rw.next) {
+		if rw.dropRate {
+			atomic.AddInt64(&rw.dropped, 1)
+			return false
+		}
+		time.Sleep(rw.next.Sub(now))
+		now = rw.next
+	}
+	rw.next = now.Add(rw.interval)
+	return true
+}
+
+// Dropped the number of lines dropped by the high water mark or the rate limit
+func (rw *OutputStream) Dropped() int64 {
+	return atomic.LoadInt64(&rw.dropped)
+}
+
+// Close stop the high water mark forwarder after the queued lines are delivered, it's idempotent
+func (rw *OutputStream) Close() error {
+	if rw.pending != nil {
+		rw.closeOnce.Do(func() {
+			close(rw.pending)
+		})
+	}
+	return nil
+}
+
+// finish send the incomplete last line, close streamChan after the queued lines are delivered.
+// pending is left to Close of the caller, finish only stops the forwarder.
+func (rw *OutputStream) finish() {
+	rw.finishOnce.Do(func() {
+		if rw.lastChar > 0 {
+			rw.send(string(rw.buf[:rw.lastChar]))
+			rw.lastChar = 0
+		}
+
+		if rw.forwarded != nil {
+			close(rw.stop)
+			<-rw.forwarded
+		}
+		close(rw.streamChan)
+	})
+}
+
+func (rw *OutputStream) send(line string) {
+	if rw.interval > 0 && !rw.pace() {
+		return
+	}
+
+	if rw.pending == nil {
+		rw.streamChan <- line // blocks if chan full
+		return
+	}
+
+	select {
+	case rw.pending <- line:
+	default:
+		atomic.AddInt64(&rw.dropped, 1)
+	}
+}
+
+// BatchOutputStream deliver lines in batches, a batch is flushed when it reaches batchSize
+// lines or interval has passed, reduce channel contention for the high-throughput commands.
+type BatchOutputStream struct {
+	sync.Mutex
+
+	batchChan chan []string
+	batchSize int
+	lines     *lineWriter
+	pending   []string
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewBatchOutputStream creates a new batch streaming output on the given channel, call Close to flush the last batch.
+func NewBatchOutputStream(batchChan chan []string, batchSize int, interval time.Duration) *BatchOutputStream {
+	if batchSize <= 0 || interval <= 0 {
+		panic("batchSize > 0 and interval > 0")
+	}
+
+	out := &BatchOutputStream{
+		batchChan: batchChan,
+		batchSize: batchSize,
+		pending:   make([]string, 0, batchSize),
+		closed:    make(chan struct{}),
+	}
+	out.lines = newLineWriter(func(line string) {
+		out.pending = append(out.pending, line)
+		if len(out.pending) >= out.batchSize {
+			out.flush()
+		}
+	})
+
+	go out.loop(interval)
+	return out
+}
+
+func (rw *BatchOutputStream) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rw.Lock()
+			rw.flush()
+			rw.Unlock()
+
+		case <-rw.closed:
+			return
+		}
+	}
+}
+
+// flush send the pending lines, must hold the lock.
+func (rw *BatchOutputStream) flush() {
+	if len(rw.pending) == 0 {
+		return
+	}
+	rw.batchChan <- rw.pending // blocks if chan full
+	rw.pending = make([]string, 0, rw.batchSize)
+}
+
+// Write makes BatchOutputStream implement the io.Writer interface.
+func (rw *BatchOutputStream) Write(p []byte) (int, error) {
+	rw.Lock()
+	defer rw.Unlock()
+	return rw.lines.Write(p)
+}
+
+// Close flush the incomplete line and the last batch, stop the interval flusher.
+func (rw *BatchOutputStream) Close() error {
+	rw.closeOnce.Do(func() {
+		close(rw.closed)
+
+		rw.Lock()
+		rw.lines.Flush()
+		rw.flush()
+		rw.Unlock()
+	})
+	return nil
+}
+
+func (rw *BatchOutputStream) Batches() <-chan []string {
+	return rw.batchChan
+}
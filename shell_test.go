@@ -1,14 +1,29 @@
 package shell
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding/simplifiedchinese"
 )
 
 func TestFastStop(t *testing.T) {
@@ -99,6 +114,45 @@ func TestRunTimeout(t *testing.T) {
 	assert.Less(t, status.CostTime.Seconds(), float64(3))
 }
 
+func TestWithDeadline(t *testing.T) {
+	deadline := time.Now().Add(500 * time.Millisecond)
+	cmd := NewCommand("sleep 10", WithDeadline(deadline), WithTimeout(5))
+	cmd.Start()
+	cmd.Wait()
+
+	assert.True(t, errors.Is(cmd.Status.Error, ErrProcessTimeout))
+	assert.False(t, time.Now().Before(deadline))
+	assert.Less(t, time.Since(deadline).Seconds(), 0.5)
+
+	// the passed deadline fails fast
+	cmd = NewCommand("echo 123", WithDeadline(time.Now().Add(-time.Second)))
+	assert.Equal(t, cmd.Start(), ErrProcessTimeout)
+	assert.Nil(t, cmd.stdcmd)
+}
+
+func TestRunTwice(t *testing.T) {
+	cmd := NewCommand("echo 123")
+	assert.Nil(t, cmd.Run())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Run()
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(t, err, ErrAlreadyFinished)
+	case <-time.After(time.Second):
+		t.Fatal("the second Run hangs")
+	}
+	assert.Equal(t, cmd.Status.Output, "123\n")
+
+	// the start error is returned
+	cmd = NewCommand("cat", WithStdinFile("/not-exist-dir/stdin"))
+	err := cmd.Run()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "open stdin file failed")
+}
+
 func TestCheckStderr(t *testing.T) {
 	cmd := NewCommand("echo -n \"123123\" >&2")
 	cmd.Run() // start and wait
@@ -153,6 +207,27 @@ func TestCheckStream(t *testing.T) {
 	assert.Equal(t, incr, 3)
 }
 
+func TestCheckStreamConsumed(t *testing.T) {
+	// wait for the consumer before counting the lines
+	stdoutChan := make(chan string, 100)
+	lines := []string{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for line := range stdoutChan {
+			lines = append(lines, line)
+		}
+	}()
+
+	cmd := exec.Command("bash", "-c", "echo 123;sleep 0.1;echo 456; echo 789")
+	cmd.Stdout = NewOutputStream(stdoutChan)
+	cmd.Run()
+	close(stdoutChan)
+	<-done
+
+	assert.Equal(t, lines, []string{"123", "456", "789"})
+}
+
 func TestCheckBuffer(t *testing.T) {
 	cmd := exec.Command("bash", "-c", "echo 123")
 	stdout := NewOutputBuffer()
@@ -191,3 +266,1291 @@ func TestCommandWithChan(t *testing.T) {
 	assert.Equal(t, len(queue), 2)
 	assert.Equal(t, err, nil)
 }
+
+func TestCommandWithChanSized(t *testing.T) {
+	script := "head -c 1048576 /dev/zero | tr '\\0' a; echo; echo next"
+	queue := make(chan string, 10)
+	err := CommandWithChanSized(script, queue, 2<<20)
+	assert.Nil(t, err)
+
+	var lines []string
+	for line := range queue {
+		lines = append(lines, line)
+	}
+	assert.Equal(t, len(lines), 2)
+	assert.Equal(t, len(lines[0]), 1<<20)
+	assert.Equal(t, lines[1], "next")
+
+	queue = make(chan string, 10)
+	err = CommandWithChanSized(script, queue, 64<<10)
+	assert.Equal(t, err, ErrLineBufferOverflow)
+}
+
+func TestCommandWithChans(t *testing.T) {
+	stdoutCh, stderrCh := make(chan string), make(chan string)
+	var stdout, stderr []string
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for line := range stdoutCh {
+			stdout = append(stdout, line)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for line := range stderrCh {
+			stderr = append(stderr, line)
+		}
+	}()
+
+	code, err := CommandWithChans("for i in 1 2 3; do echo out $i; echo err $i >&2; done; exit 3", stdoutCh, stderrCh)
+	wg.Wait()
+	assert.NotNil(t, err)
+	assert.Equal(t, code, 3)
+	assert.Equal(t, stdout, []string{"out 1", "out 2", "out 3"})
+	assert.Equal(t, stderr, []string{"err 1", "err 2", "err 3"})
+}
+
+func TestUmask(t *testing.T) {
+	cmd := NewCommand("umask", WithUmask(0027))
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, "0027\n")
+
+	// the exec mode command is run as is, it inherits the umask
+	old := syscall.Umask(0022)
+	defer syscall.Umask(old)
+	cmd = NewCommand("bash -c umask", WithExecMode(true), WithUmask(0027))
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, "0022\n")
+}
+
+func TestFailedOutput(t *testing.T) {
+	cmd := NewCommand("echo out; echo err >&2; exit 3")
+	cmd.Run()
+	assert.Equal(t, cmd.Status.ExitCode, 3)
+	assert.NotNil(t, cmd.Status.Error)
+	assert.Equal(t, cmd.Status.Stdout, "out\n")
+	assert.Equal(t, cmd.Status.Stderr, "err\n")
+	// the pipes are read concurrently, the order of the output lines isn't fixed
+	assert.Contains(t, cmd.Status.Output, "out\n")
+	assert.Contains(t, cmd.Status.Output, "err\n")
+	assert.Equal(t, len(cmd.Status.Output), len("out\nerr\n"))
+
+	// the stopped command keeps the output so far, it isn't written after Wait returns
+	cmd = NewCommand("echo out; sleep 10", WithTimeout(1))
+	cmd.Run()
+	assert.True(t, errors.Is(cmd.Status.Error, ErrProcessTimeout))
+	assert.Equal(t, cmd.Status.Output, "out\n")
+}
+
+func TestUmaskCreateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-shell-umask")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fpath := dir + "/file"
+	cmd := NewCommand("touch "+fpath, WithUmask(0077))
+	cmd.Run()
+	assert.Nil(t, cmd.Status.Error)
+
+	info, err := os.Stat(fpath)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0600))
+}
+
+func TestWithStrictMode(t *testing.T) {
+	cmd := NewCommand("echo before; false; echo after")
+	cmd.Run()
+	assert.Equal(t, cmd.Status.ExitCode, 0)
+	assert.Equal(t, cmd.Status.Output, "before\nafter\n")
+
+	cmd = NewCommand("echo before; false; echo after", WithStrictMode())
+	cmd.Run()
+	assert.Equal(t, cmd.Status.ExitCode, 1)
+	assert.Equal(t, cmd.Status.Output, "before\n")
+
+	cmd = NewCommand("false | true", WithStrictMode())
+	cmd.Run()
+	assert.Equal(t, cmd.Status.ExitCode, 1)
+
+	cmd = NewCommand("echo $NOT_SET_VAR", WithStrictMode())
+	cmd.Run()
+	assert.NotEqual(t, cmd.Status.ExitCode, 0)
+	assert.Contains(t, cmd.Status.Stderr, "NOT_SET_VAR")
+
+	// exec mode isn't wrapped
+	cmd = NewCommand("echo 123", WithExecMode(true), WithStrictMode())
+	cmd.Run()
+	assert.Nil(t, cmd.Status.Error)
+	assert.Equal(t, cmd.Status.Output, "123\n")
+}
+
+func TestNewCommandE(t *testing.T) {
+	errOption := errors.New("bad option")
+	badOption := func(c *Cmd) error {
+		return errOption
+	}
+
+	cmd, err := NewCommandE("echo 123", WithShellMode(), badOption)
+	assert.Nil(t, cmd)
+	assert.Equal(t, err, errOption)
+
+	cmd, err = NewCommandE("echo -n 123", WithShellMode())
+	assert.Nil(t, err)
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, "123")
+}
+
+func TestCombinedOutputNotTorn(t *testing.T) {
+	cmd := NewCommand(`
+	for i in $(seq 1 2000); do
+		echo "stdout-line-$i"
+		echo "stderr-line-$i" >&2
+	done
+	`)
+	cmd.Run()
+	status := cmd.Status
+
+	lines := strings.Split(strings.TrimSuffix(status.Output, "\n"), "\n")
+	assert.Equal(t, len(lines), 4000)
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "stdout-line-") && !strings.HasPrefix(line, "stderr-line-") {
+			t.Fatalf("torn line: %q", line)
+		}
+	}
+	assert.Equal(t, len(status.Output), len(status.Stdout)+len(status.Stderr))
+}
+
+func TestWithLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.New(buf, "", 0)
+
+	cmd := NewCommand("echo 123", WithLogger(logger))
+	cmd.Run()
+
+	assert.Contains(t, buf.String(), "starting command")
+	assert.Contains(t, buf.String(), "finalize command")
+}
+
+func TestLoginShell(t *testing.T) {
+	home, err := ioutil.TempDir("", "go-shell-home")
+	assert.Nil(t, err)
+	defer os.RemoveAll(home)
+
+	err = ioutil.WriteFile(home+"/.bash_profile", []byte("export GO_SHELL_PROFILE=login\n"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(home+"/.bashrc", []byte("export GO_SHELL_PROFILE=interactive\n"), 0644)
+	assert.Nil(t, err)
+
+	env := []string{"HOME=" + home, "PATH=" + os.Getenv("PATH")}
+
+	cmd := NewCommand("echo -n $GO_SHELL_PROFILE", WithSetEnv(env))
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Stdout, "")
+
+	cmd = NewCommand("echo -n $GO_SHELL_PROFILE", WithSetEnv(env), WithLoginShell())
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Stdout, "login")
+
+	cmd = NewCommand("echo -n $GO_SHELL_PROFILE", WithSetEnv(env), WithInteractiveShell())
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Stdout, "interactive")
+}
+
+func TestOutputBytes(t *testing.T) {
+	cmd := NewCommand("echo -n 12345; echo -n abc >&2")
+	cmd.Run()
+	status := cmd.Status
+
+	assert.Equal(t, status.StdoutBytes, int64(5))
+	assert.Equal(t, status.StderrBytes, int64(3))
+	assert.Equal(t, status.StdoutBytes, int64(len(status.Stdout)))
+	assert.Equal(t, status.StderrBytes, int64(len(status.Stderr)))
+}
+
+func TestCommandScriptContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	out, _, err := CommandScriptContext(ctx, []byte("echo $0; sleep 10"))
+	assert.Less(t, time.Since(start).Seconds(), float64(2))
+	assert.Equal(t, err, ErrProcessCancel)
+
+	fpath := strings.TrimSpace(out)
+	assert.True(t, strings.HasPrefix(fpath, "/tmp/go-shell-"))
+	_, err = os.Stat(fpath)
+	assert.True(t, os.IsNotExist(err))
+
+	out, code, err := CommandScriptContext(context.Background(), []byte("echo -n 123"))
+	assert.Equal(t, out, "123")
+	assert.Equal(t, code, 0)
+	assert.Nil(t, err)
+}
+
+func TestCommandScriptCleanup(t *testing.T) {
+	for _, script := range []string{"echo $0", "echo $0; exit 3"} {
+		out, _, _ := CommandScript([]byte(script))
+		fpath := strings.TrimSpace(out)
+		assert.True(t, strings.HasPrefix(fpath, "/tmp/go-shell-"))
+		_, err := os.Stat(fpath)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	out, code, err := CommandScript([]byte("echo $0; exit 3"))
+	assert.NotNil(t, err)
+	assert.Equal(t, code, 3)
+	assert.NotEmpty(t, out)
+}
+
+func TestWithRedactEnv(t *testing.T) {
+	buf := &bytes.Buffer{}
+	env := []string{"MY_KEY=key-value", "API_TOKEN=token-value", "NAME=xiaorui"}
+
+	cmd := NewCommand("echo -n $MY_KEY $API_TOKEN", WithSetEnv(env), WithRedactEnv("MY_KEY"), WithLogger(log.New(buf, "", 0)))
+	cmd.Run()
+
+	assert.Equal(t, cmd.Status.Output, "key-value token-value")
+	assert.Contains(t, buf.String(), `"MY_KEY=***"`)
+	assert.Contains(t, buf.String(), `"API_TOKEN=***"`)
+	assert.Contains(t, buf.String(), `"NAME=xiaorui"`)
+	assert.NotContains(t, buf.String(), "key-value")
+	assert.NotContains(t, buf.String(), "token-value")
+}
+
+func TestWaitStatus(t *testing.T) {
+	cmd := NewCommand("echo -n 123; exit 3")
+	cmd.Start()
+	status := cmd.WaitStatus()
+
+	assert.Equal(t, status.ExitCode, 3)
+	assert.Equal(t, status.Finish, true)
+	assert.Equal(t, status.Output, "123")
+}
+
+func TestBatchOutputStream(t *testing.T) {
+	batchChan := make(chan []string, 10)
+	var (
+		lines   []string
+		batches int
+		maxSize int
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for batch := range batchChan {
+			batches++
+			if len(batch) > maxSize {
+				maxSize = len(batch)
+			}
+			lines = append(lines, batch...)
+		}
+	}()
+
+	cmd := exec.Command("bash", "-c", "seq 1 10000")
+	stdout := NewBatchOutputStream(batchChan, 100, 50*time.Millisecond)
+	cmd.Stdout = stdout
+	cmd.Run()
+	stdout.Close()
+	close(batchChan)
+	<-done
+
+	assert.Equal(t, len(lines), 10000)
+	assert.Equal(t, lines[0], "1")
+	assert.Equal(t, lines[9999], "10000")
+	assert.LessOrEqual(t, maxSize, 100)
+	assert.GreaterOrEqual(t, batches, 100)
+	assert.Less(t, batches, 10000)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	cmd := NewCommand("echo 1; sleep 0.5; echo 2; sleep 10", WithIdleTimeout(time.Second))
+	cmd.Run()
+	status := cmd.WaitStatus() // the output is still captured after Stop
+
+	assert.Equal(t, status.Error, ErrIdleTimeout)
+	assert.GreaterOrEqual(t, status.CostTime.Seconds(), 1.5)
+	assert.Less(t, status.CostTime.Seconds(), float64(3))
+
+	cmd = NewCommand("echo 1; sleep 0.5; echo 2", WithIdleTimeout(time.Second))
+	cmd.Run()
+	assert.Nil(t, cmd.Status.Error)
+}
+
+func TestOutputEncoding(t *testing.T) {
+	// "你好" in GBK
+	gbk := `printf '\xc4\xe3\xba\xc3'`
+
+	cmd := NewCommand(gbk, WithOutputEncoding(simplifiedchinese.GBK))
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, "你好")
+	assert.Equal(t, cmd.Status.Stdout, "你好")
+
+	cmd = NewCommand(gbk)
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, "\xc4\xe3\xba\xc3")
+}
+
+func TestWithCmdHook(t *testing.T) {
+	r, w, err := os.Pipe()
+	assert.Nil(t, err)
+	defer r.Close()
+
+	w.Write([]byte("from-fd-3"))
+	w.Close()
+
+	hook := func(c *exec.Cmd) {
+		c.ExtraFiles = []*os.File{r}
+	}
+	cmd := NewCommand("cat <&3", WithCmdHook(hook))
+	cmd.Run()
+
+	assert.Nil(t, cmd.Status.Error)
+	assert.Equal(t, cmd.Status.Output, "from-fd-3")
+}
+
+func TestCheckCmdVersion(t *testing.T) {
+	pattern := `go(\d+(\.\d+)*)`
+
+	ok, err := CheckCmdVersion("echo", "go version go1.21.3 linux/amd64", pattern, "1.20")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = CheckCmdVersion("echo", "go version go1.21.3 linux/amd64", pattern, "1.21.3")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = CheckCmdVersion("echo", "go version go1.9 linux/amd64", pattern, "1.10")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = CheckCmdVersion("echo", "unknown", pattern, "1.10")
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+
+	ok, err = CheckCmdVersion("xiaorui.cc", "--version", pattern, "1.10")
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+}
+
+func TestCompareVersion(t *testing.T) {
+	assert.Equal(t, compareVersion("1.2.3", "1.2.3"), 0)
+	assert.Equal(t, compareVersion("1.2", "1.2.0"), 0)
+	assert.Equal(t, compareVersion("v1.10.0", "1.9.9"), 1)
+	assert.Equal(t, compareVersion("1.2.3-rc1", "1.2.4"), -1)
+}
+
+func TestTryWait(t *testing.T) {
+	cmd := NewCommand("sleep 1; exit 3")
+	cmd.Start()
+
+	status, ok := cmd.TryWait()
+	assert.False(t, ok)
+	assert.Equal(t, status.Finish, false)
+
+	cmd.Wait()
+	status, ok = cmd.TryWait()
+	assert.True(t, ok)
+	assert.Equal(t, status.ExitCode, 3)
+}
+
+func TestWithPidFile(t *testing.T) {
+	fpath := fmt.Sprintf("/tmp/go-shell-pid-%d", time.Now().UnixNano())
+	cmd := NewCommand("sleep 1", WithPidFile(fpath))
+	cmd.Start()
+
+	bs, err := ioutil.ReadFile(fpath)
+	assert.Nil(t, err)
+	assert.Equal(t, string(bs), strconv.Itoa(cmd.stdcmd.Process.Pid))
+
+	cmd.Wait()
+	assert.Nil(t, cmd.Status.Error)
+	_, err = os.Stat(fpath)
+	assert.True(t, os.IsNotExist(err))
+
+	cmd = NewCommand("echo -n 123", WithPidFile("/not-exist-dir/pid"))
+	cmd.Run()
+	assert.NotNil(t, cmd.Status.Error)
+	assert.Equal(t, cmd.Status.Output, "123")
+}
+
+func TestCommandSafe(t *testing.T) {
+	marker := fmt.Sprintf("/tmp/go-shell-safe-%d", time.Now().UnixNano())
+	arg := "; touch " + marker + "; rm -rf " + marker
+
+	out, code, err := CommandSafe("echo", arg)
+	assert.Nil(t, err)
+	assert.Equal(t, code, 0)
+	assert.Equal(t, out, arg+"\n")
+
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err))
+
+	_, code, err = CommandSafe("xiaorui.cc")
+	assert.NotNil(t, err)
+	assert.Equal(t, code, DefaultExitCode)
+}
+
+func TestWithExtraFiles(t *testing.T) {
+	r1, w1, err := os.Pipe()
+	assert.Nil(t, err)
+	defer r1.Close()
+	r2, w2, err := os.Pipe()
+	assert.Nil(t, err)
+	defer r2.Close()
+
+	w1.Write([]byte("fd3,"))
+	w1.Close()
+	w2.Write([]byte("fd4"))
+	w2.Close()
+
+	cmd := NewCommand("cat <&3; cat <&4", WithExtraFiles(r1, r2))
+	cmd.Run()
+
+	assert.Nil(t, cmd.Status.Error)
+	assert.Equal(t, cmd.Status.Output, "fd3,fd4")
+}
+
+func TestTimeoutTimerStopped(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		cmd := NewCommand("echo 123", WithTimeout(10))
+		cmd.Run()
+
+		assert.NotNil(t, cmd.timeoutTimer)
+		// false means the timer has been stopped by finalize
+		assert.False(t, cmd.timeoutTimer.Stop())
+	}
+}
+
+func TestCommandWithChanContext(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queue := make(chan string)
+	result := make(chan error, 1)
+	go func() {
+		result <- CommandWithChanContext(ctx, "while true; do echo 123; done", queue)
+	}()
+
+	// consume one line then abandon the queue
+	assert.Equal(t, <-queue, "123")
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-result:
+		assert.Equal(t, err, ErrProcessCancel)
+	case <-time.After(2 * time.Second):
+		t.Fatal("CommandWithChanContext not return after cancel")
+	}
+
+	// the queue is closed
+	for range queue {
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	if !CheckCmdExists("python3") {
+		t.Skip("python3 not found")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := ln.Addr().String()
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	probe := func() bool {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	server := fmt.Sprintf(`sleep 0.5; exec python3 -c 'import socket, time
+s = socket.socket()
+s.bind(("127.0.0.1", %d))
+s.listen(1)
+time.sleep(30)'`, port)
+	cmd := NewCommand(server)
+	cmd.Start()
+	defer cmd.Stop()
+
+	assert.False(t, probe())
+	err = cmd.WaitUntilReady(probe, 100*time.Millisecond, 5*time.Second)
+	assert.Nil(t, err)
+	assert.True(t, probe())
+
+	cmd = NewCommand("sleep 10")
+	cmd.Start()
+	start := time.Now()
+	err = cmd.WaitUntilReady(func() bool { return false }, 100*time.Millisecond, 500*time.Millisecond)
+	assert.Equal(t, err, ErrNotReady)
+	assert.Less(t, time.Since(start).Seconds(), float64(2))
+	cmd.Wait()
+}
+
+func TestAppendArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-shell append")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/file", []byte("123"), 0644)
+
+	cmd := NewCommand("ls", WithExecMode(true))
+	cmd.AppendArgs("-1")
+	cmd.AppendArgs(dir)
+	cmd.Run()
+	assert.Nil(t, cmd.Status.Error)
+	assert.Equal(t, cmd.Status.Output, "file\n")
+
+	cmd = NewCommand("ls")
+	cmd.AppendArgs("-1", dir)
+	cmd.Run()
+	assert.Nil(t, cmd.Status.Error)
+	assert.Equal(t, cmd.Status.Output, "file\n")
+
+	cmd = NewCommand("echo")
+	cmd.AppendArgs("a  b", "$HOME;")
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, "a  b $HOME;\n")
+}
+
+func TestResolvedDir(t *testing.T) {
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+
+	cmd, err := NewCommandE("pwd", WithSetDir("."))
+	assert.Nil(t, err)
+	cmd.Run()
+
+	assert.True(t, filepath.IsAbs(cmd.Status.ResolvedDir))
+	assert.Equal(t, cmd.Status.ResolvedDir, wd)
+	assert.Equal(t, cmd.Status.Output, wd+"\n")
+}
+
+func TestOutputBufferLimit(t *testing.T) {
+	cmd := exec.Command("bash", "-c", "seq 1 1000")
+	stdout := NewOutputBufferLimit(10)
+	cmd.Stdout = stdout
+	cmd.Run()
+
+	lines := stdout.Lines()
+	assert.Equal(t, len(lines), 10)
+	assert.Equal(t, lines[0], "991")
+	assert.Equal(t, lines[9], "1000")
+	assert.Equal(t, stdout.buf.Len(), 0)
+}
+
+func TestOutputStreamHighWaterMark(t *testing.T) {
+	stdoutChan := make(chan string)
+	received := int64(0)
+	go func() {
+		for range stdoutChan {
+			atomic.AddInt64(&received, 1)
+			time.Sleep(10 * time.Millisecond) // slow consumer
+		}
+	}()
+
+	cmd := exec.Command("bash", "-c", "seq 1 10000")
+	stdout := NewOutputStream(stdoutChan)
+	stdout.SetHighWaterMark(100)
+	cmd.Stdout = stdout
+
+	start := time.Now()
+	cmd.Run()
+	stdout.Close()
+
+	// the producer isn't blocked by the consumer
+	assert.Less(t, time.Since(start).Seconds(), float64(2))
+	assert.Greater(t, stdout.Dropped(), int64(0))
+	assert.LessOrEqual(t, stdout.Dropped(), int64(10000-100))
+
+	// the queued lines are still delivered
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&received) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Greater(t, atomic.LoadInt64(&received), int64(0))
+}
+
+func TestContext(t *testing.T) {
+	cmd := NewCommand("sleep 10")
+	ctx := cmd.Context()
+	assert.NotNil(t, ctx)
+	assert.Nil(t, ctx.Err())
+
+	cmd.Start()
+	assert.Equal(t, cmd.Context(), ctx)
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, ctx.Err())
+
+	cmd.Stop()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context isn't canceled after Stop")
+	}
+
+	// done after the normal exit, the retry attempts share it
+	cmd = NewCommand("exit 1", WithRetry(3, 10*time.Millisecond))
+	ctx = cmd.Context()
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Attempts, 3)
+	assert.NotNil(t, ctx.Err())
+}
+
+func TestSnapshot(t *testing.T) {
+	cmd := NewCommand("echo out1; echo err1 >&2; sleep 0.5; echo out2; echo err2 >&2")
+	stdout, stderr := cmd.Snapshot()
+	assert.Equal(t, stdout+stderr, "")
+
+	cmd.Start()
+	time.Sleep(200 * time.Millisecond)
+	stdout, stderr = cmd.Snapshot()
+	assert.Equal(t, stdout, "out1\n")
+	assert.Equal(t, stderr, "err1\n")
+
+	cmd.Wait()
+	stdout, stderr = cmd.Snapshot()
+	assert.Equal(t, stdout, "out1\nout2\n")
+	assert.Equal(t, stderr, "err1\nerr2\n")
+}
+
+func TestSnapshotRace(t *testing.T) {
+	cmd := NewCommand("for i in $(seq 1 2000); do echo out $i; echo err $i >&2; done")
+	cmd.Start()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-cmd.Context().Done():
+				return
+			default:
+			}
+			stdout, stderr := cmd.Snapshot()
+			assert.False(t, strings.Contains(stdout, "err") || strings.Contains(stderr, "out"))
+		}
+	}()
+	cmd.Wait()
+	<-done
+
+	stdout, stderr := cmd.Snapshot()
+	assert.Equal(t, stdout, cmd.Status.Stdout)
+	assert.Equal(t, stderr, cmd.Status.Stderr)
+}
+
+func TestClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	cmd := NewCommand("sleep 10", WithTimeout(10), WithIdleTimeout(10*time.Second))
+	cmd.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	assert.Nil(t, cmd.Close())
+	assert.Nil(t, cmd.Close())
+	assert.Less(t, time.Since(start).Seconds(), float64(1))
+	assert.Equal(t, cmd.Status.Finish, true)
+	assert.NotNil(t, cmd.ctx.Err())
+	if cmd.timeoutTimer != nil {
+		assert.False(t, cmd.timeoutTimer.Stop())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+
+	// close before start
+	assert.Nil(t, NewCommand("echo 123").Close())
+}
+
+func TestCommandClean(t *testing.T) {
+	assert.NotEqual(t, os.Getenv("HOME"), "")
+
+	out, code, err := CommandClean("echo -n \"$HOME\"")
+	assert.Nil(t, err)
+	assert.Equal(t, code, 0)
+	assert.Equal(t, out, "")
+
+	out, _, err = CommandClean("echo -n \"$HOME,$NAME\"", "NAME=xiaorui")
+	assert.Nil(t, err)
+	assert.Equal(t, out, ",xiaorui")
+}
+
+func TestCommandAll(t *testing.T) {
+	marker := fmt.Sprintf("/tmp/go-shell-all-%d", time.Now().UnixNano())
+	defer os.Remove(marker)
+
+	outputs, failedIndex, err := CommandAll("echo 1", "echo 2; exit 3", "touch "+marker)
+	assert.NotNil(t, err)
+	assert.Equal(t, failedIndex, 1)
+	assert.Equal(t, outputs, []string{"1\n", "2\n"})
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err))
+
+	outputs, failedIndex, err = CommandAll("echo 1", "echo 2")
+	assert.Nil(t, err)
+	assert.Equal(t, failedIndex, -1)
+	assert.Equal(t, outputs, []string{"1\n", "2\n"})
+}
+
+func TestCommandIf(t *testing.T) {
+	marker := fmt.Sprintf("/tmp/go-shell-if-%d", time.Now().UnixNano())
+	defer os.Remove(marker)
+
+	out, code, err := CommandIf("test -e "+marker, "echo exists")
+	assert.Equal(t, err, ErrCommandSkipped)
+	assert.Equal(t, code, 1)
+	assert.Equal(t, out, "")
+
+	out, code, err = CommandIf("! test -e "+marker, "touch "+marker+"; echo created")
+	assert.Nil(t, err)
+	assert.Equal(t, code, 0)
+	assert.Equal(t, out, "created\n")
+
+	out, code, err = CommandIf("test -e "+marker, "echo exists; exit 3")
+	assert.NotNil(t, err)
+	assert.NotEqual(t, err, ErrCommandSkipped)
+	assert.Equal(t, code, 3)
+	assert.Equal(t, out, "exists\n")
+}
+
+func TestCommandSession(t *testing.T) {
+	out, code, err := CommandSession("name=world", "cd /tmp", "echo hello $name", "pwd")
+	assert.Nil(t, err)
+	assert.Equal(t, code, 0)
+	assert.Equal(t, out, "hello world\n/tmp\n")
+
+	// the failure in the middle doesn't stop the session
+	out, code, err = CommandSession("false", "echo after")
+	assert.Nil(t, err)
+	assert.Equal(t, out, "after\n")
+
+	out, code, err = CommandSessionStrict("echo before", "false", "echo after")
+	assert.NotNil(t, err)
+	assert.Equal(t, code, 1)
+	assert.Equal(t, out, "before\n")
+}
+
+func TestShellFallback(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	assert.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "go-shell-path")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.Symlink(sh, dir+"/sh"))
+
+	origin := os.Getenv("PATH")
+	defer os.Setenv("PATH", origin)
+
+	// only sh in PATH, fallback to sh
+	os.Setenv("PATH", dir)
+	cmd := NewCommand(`echo -n "$0"`)
+	cmd.Run()
+	assert.Nil(t, cmd.Status.Error)
+	assert.Equal(t, cmd.Status.Output, dir+"/sh")
+
+	// no shell in PATH
+	os.Setenv("PATH", dir+"/not-exist")
+	cmd = NewCommand("echo 123")
+	err = cmd.Start()
+	assert.True(t, errors.Is(err, ErrShellNotFound))
+
+	cmd = NewCommand("echo 123", WithShell("zsh-not-exist"))
+	err = cmd.Start()
+	assert.True(t, errors.Is(err, ErrShellNotFound))
+}
+
+func TestWithOutputFilter(t *testing.T) {
+	re := regexp.MustCompile(`token=\w+`)
+	mask := func(line string) string {
+		return re.ReplaceAllString(line, "token=***")
+	}
+
+	cmd := NewCommand("echo login token=abc123; echo token=def456 >&2; echo -n done token=xyz", WithOutputFilter(mask))
+	events := cmd.Events()
+	cmd.Start()
+
+	var lines []string
+	for ev := range events {
+		if ev.Type != EventExit {
+			lines = append(lines, ev.Line)
+		}
+	}
+	cmd.Wait()
+	status := cmd.Status
+
+	assert.Equal(t, status.Stdout, "login token=***\ndone token=***")
+	assert.Equal(t, status.Stderr, "token=***\n")
+	assert.NotContains(t, status.Output, "abc123")
+	assert.Contains(t, lines, "login token=***")
+	assert.Contains(t, lines, "token=***")
+}
+
+func TestStatusSuccess(t *testing.T) {
+	cmd := NewCommand("echo 123")
+	cmd.Run()
+	assert.True(t, cmd.Status.Success())
+
+	cmd = NewCommand("exit 3")
+	cmd.Run()
+	assert.False(t, cmd.Status.Success())
+	assert.Equal(t, cmd.Status.ExitCode, 3)
+
+	cmd = NewCommand("xiaorui.cc")
+	cmd.Run()
+	assert.False(t, cmd.Status.Success())
+	assert.Equal(t, cmd.Status.ExitCode, 127)
+}
+
+func TestWithLineWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	cmd := NewCommand("echo hello; echo world", WithLineWriter(buf, true))
+	cmd.Run()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Equal(t, len(lines), 2)
+	for i, text := range []string{"hello", "world"} {
+		parts := strings.SplitN(lines[i], " ", 2)
+		_, err := time.Parse(time.RFC3339, parts[0])
+		assert.Nil(t, err)
+		assert.Equal(t, parts[1], text)
+	}
+
+	buf.Reset()
+	NewCommand("echo plain", WithLineWriter(buf, false)).Run()
+	assert.Equal(t, buf.String(), "plain\n")
+}
+
+func TestCommandContextFamily(t *testing.T) {
+	variants := map[string]func(ctx context.Context) error{
+		"CommandContext": func(ctx context.Context) error {
+			_, _, err := CommandContext(ctx, "sleep 10")
+			return err
+		},
+		"CommandFormatContext": func(ctx context.Context) error {
+			_, _, err := CommandFormatContext(ctx, "sleep %d", 10)
+			return err
+		},
+		"CommandScriptContext": func(ctx context.Context) error {
+			_, _, err := CommandScriptContext(ctx, []byte("sleep 10"))
+			return err
+		},
+		"CommandContainsContext": func(ctx context.Context) error {
+			if CommandContainsContext(ctx, "sleep 10; echo done", "done") {
+				return errors.New("unexpected match")
+			}
+			return ctx.Err()
+		},
+	}
+
+	for name, fn := range variants {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		start := time.Now()
+		err := fn(ctx)
+		cancel()
+
+		assert.NotNil(t, err, name)
+		assert.Less(t, time.Since(start).Seconds(), float64(2), name)
+	}
+
+	out, code, err := CommandFormatContext(context.Background(), "echo -n %s", "123")
+	assert.Equal(t, out, "123")
+	assert.Equal(t, code, 0)
+	assert.Nil(t, err)
+	assert.True(t, CommandContainsContext(context.Background(), "echo hello world", "hello", "world"))
+}
+
+func TestCommandLine(t *testing.T) {
+	out, code, err := CommandLine("echo hello")
+	assert.Equal(t, out, "hello")
+	assert.Equal(t, code, 0)
+	assert.Nil(t, err)
+
+	out, code, _ = CommandLine("echo '  failed  '; exit 2")
+	assert.Equal(t, out, "failed")
+	assert.Equal(t, code, 2)
+}
+
+func TestCommandTable(t *testing.T) {
+	sample := "Filesystem  Size  Used Mounted on\n/dev/sda1   50G   20G  /   \n\ntmpfs       1G    0    /dev/shm\n"
+	rows, header := parseTable(sample, true, strings.Fields)
+	assert.Equal(t, header, []string{"Filesystem", "Size", "Used", "Mounted", "on"})
+	assert.Equal(t, rows, [][]string{
+		{"/dev/sda1", "50G", "20G", "/"},
+		{"tmpfs", "1G", "0", "/dev/shm"},
+	})
+
+	rows, header, err := CommandTable("printf 'a b c\\nd e\\n'", false)
+	assert.Nil(t, err)
+	assert.Nil(t, header)
+	assert.Equal(t, rows, [][]string{{"a", "b", "c"}, {"d", "e"}})
+
+	comma := func(line string) []string { return strings.Split(line, ",") }
+	rows, header, err = CommandTableFunc("printf 'name,age\\nxiaorui,18\\n'", true, comma)
+	assert.Nil(t, err)
+	assert.Equal(t, header, []string{"name", "age"})
+	assert.Equal(t, rows, [][]string{{"xiaorui", "18"}})
+
+	_, _, err = CommandTable("exit 3", false)
+	assert.NotNil(t, err)
+}
+
+func TestWithStdinFile(t *testing.T) {
+	fpath := filepath.Join(os.TempDir(), "go-shell-stdin-"+randString(8))
+	err := ioutil.WriteFile(fpath, []byte("a\nb\nc\n"), 0644)
+	assert.Nil(t, err)
+	defer os.Remove(fpath)
+
+	cmd := NewCommand("wc -l", WithStdinFile(fpath))
+	cmd.Run()
+	assert.Equal(t, strings.TrimSpace(cmd.Status.Output), "3")
+
+	cmd = NewCommand("cat", WithStdin(strings.NewReader("hello")))
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, "hello")
+
+	cmd = NewCommand("wc -l", WithStdinFile(fpath+"-not-exist"))
+	err = cmd.Start()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "open stdin file failed")
+}
+
+func TestWithAuditStdin(t *testing.T) {
+	cmd := NewCommand("wc -l", WithStdin(strings.NewReader("hello\nworld\n")), WithAuditStdin())
+	cmd.Run()
+	assert.Equal(t, strings.TrimSpace(cmd.Status.Output), "2")
+	assert.Equal(t, cmd.Status.StdinCapture, "hello\nworld\n")
+
+	fpath := filepath.Join(os.TempDir(), "go-shell-audit-"+randString(8))
+	err := ioutil.WriteFile(fpath, []byte(strings.Repeat("a", 100)), 0644)
+	assert.Nil(t, err)
+	defer os.Remove(fpath)
+
+	limit := DefaultAuditStdinLimit
+	DefaultAuditStdinLimit = 10
+	defer func() { DefaultAuditStdinLimit = limit }()
+
+	cmd = NewCommand("wc -c", WithStdinFile(fpath), WithAuditStdin())
+	cmd.Run()
+	assert.Equal(t, strings.TrimSpace(cmd.Status.Output), "100")
+	assert.Equal(t, cmd.Status.StdinCapture, strings.Repeat("a", 10))
+
+	cmd = NewCommand("echo 123", WithAuditStdin())
+	cmd.Run()
+	assert.Equal(t, cmd.Status.StdinCapture, "")
+}
+
+func TestWithInheritStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	assert.Nil(t, err)
+	defer r.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	w.WriteString("hello\n")
+	w.Close()
+	cmd, err := NewCommandE("read line; echo got $line", WithInheritStdin())
+	assert.Nil(t, err)
+	cmd.Run()
+	assert.Equal(t, cmd.Status.Output, "got hello\n")
+
+	_, err = NewCommandE("cat", WithInheritStdin(), WithStdin(strings.NewReader("hello")))
+	assert.NotNil(t, err)
+	_, err = NewCommandE("cat", WithStdinFile("/etc/hosts"), WithInheritStdin())
+	assert.NotNil(t, err)
+}
+
+func TestWithCombinedOrdering(t *testing.T) {
+	script := "for i in 1 2 3; do echo out$i; echo err$i >&2; done"
+	cmd := NewCommand(script, WithCombinedOrdering())
+	cmd.Run()
+
+	assert.Equal(t, cmd.Status.Output, "out1\nerr1\nout2\nerr2\nout3\nerr3\n")
+	assert.Equal(t, cmd.Status.Stdout, cmd.Status.Output)
+	assert.Equal(t, cmd.Status.Stderr, "")
+}
+
+func TestWithPassthrough(t *testing.T) {
+	r, w, err := os.Pipe()
+	assert.Nil(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	cmd := NewCommand("echo live; sleep 1; echo done", WithPassthrough())
+	cmd.Start()
+
+	// the first line arrives before the command exits
+	line, err := bufio.NewReader(r).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, line, "live\n")
+	_, finished := cmd.TryWait()
+	assert.False(t, finished)
+
+	cmd.Wait()
+	w.Close()
+	assert.Equal(t, cmd.Status.Output, "live\ndone\n")
+}
+
+func TestWithPosixSignalExitCodes(t *testing.T) {
+	cmd := NewCommand("sleep 5", WithExecMode(true), WithPosixSignalExitCodes())
+	cmd.Start()
+	time.Sleep(100 * time.Millisecond)
+	cmd.Kill(syscall.SIGTERM)
+	cmd.Wait()
+	assert.Equal(t, cmd.Status.ExitCode, 143)
+
+	cmd = NewCommand("sleep 5", WithExecMode(true))
+	cmd.Start()
+	time.Sleep(100 * time.Millisecond)
+	cmd.Kill(syscall.SIGTERM)
+	cmd.Wait()
+	assert.Equal(t, cmd.Status.ExitCode, -1)
+}
+
+func TestCommandLines(t *testing.T) {
+	lines, code, err := CommandLines(`printf 'a\nb\nc\n'`)
+	assert.Nil(t, err)
+	assert.Equal(t, code, 0)
+	assert.Equal(t, lines, []string{"a", "b", "c"})
+
+	lines, _, _ = CommandLines(`printf 'a\n\nb'`)
+	assert.Equal(t, lines, []string{"a", "", "b"})
+
+	lines, code, err = CommandLines("exit 3")
+	assert.NotNil(t, err)
+	assert.Equal(t, code, 3)
+	assert.Empty(t, lines)
+}
+
+func TestCommandExpect(t *testing.T) {
+	assert.Nil(t, CommandExpect("echo hello; echo world", "hello\nworld"))
+	assert.Nil(t, CommandExpect("echo '  hello  '", "hello"))
+
+	err := CommandExpect("echo hello; echo word", "hello\nworld")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `line 2, expected: "world", got: "word"`)
+
+	err = CommandExpect("echo hello", "hello\nworld")
+	assert.Contains(t, err.Error(), `line 2, expected: "world", got: ""`)
+}
+
+func TestWithTimeoutGrace(t *testing.T) {
+	fpath := filepath.Join(os.TempDir(), "go-shell-grace-"+randString(8))
+	defer os.Remove(fpath)
+
+	script := fmt.Sprintf("trap 'echo trapped > %s; exit 1' TERM; sleep 10 & wait", fpath)
+	cmd := NewCommand(script, WithTimeout(1), WithTimeoutGrace(2*time.Second))
+	start := time.Now()
+	cmd.Run()
+
+	assert.True(t, errors.Is(cmd.Status.Error, ErrProcessTimeout))
+	assert.Less(t, time.Since(start).Seconds(), float64(2))
+	bs, err := ioutil.ReadFile(fpath)
+	assert.Nil(t, err)
+	assert.Equal(t, string(bs), "trapped\n")
+
+	// the trap which ignores SIGTERM is killed after the grace
+	cmd = NewCommand("trap '' TERM; sleep 10", WithTimeout(1), WithTimeoutGrace(500*time.Millisecond))
+	start = time.Now()
+	cmd.Run()
+	assert.True(t, errors.Is(cmd.Status.Error, ErrProcessTimeout))
+	assert.Less(t, time.Since(start).Seconds(), float64(3))
+}
+
+func TestOutputStreamGrowableLineBuffer(t *testing.T) {
+	stdoutChan := make(chan string, 10)
+	stdout := NewOutputStream(stdoutChan, WithGrowableLineBuffer())
+
+	cmd := exec.Command("bash", "-c", "head -c 102400 /dev/zero | tr '\\0' a; echo; echo next")
+	cmd.Stdout = stdout
+	assert.Nil(t, cmd.Run())
+	close(stdoutChan)
+
+	var lines []string
+	for line := range stdoutChan {
+		lines = append(lines, line)
+	}
+	assert.Equal(t, len(lines), 2)
+	assert.Equal(t, lines[0], strings.Repeat("a", 102400))
+	assert.Equal(t, lines[1], "next")
+
+	// the line beyond the max size still overflows
+	defer func(size int) { DefaultMaxLineBufferSize = size }(DefaultMaxLineBufferSize)
+	DefaultMaxLineBufferSize = 32768
+	stdout = NewOutputStream(make(chan string, 10), WithGrowableLineBuffer())
+	_, err := stdout.Write(bytes.Repeat([]byte("a"), 102400))
+	assert.Equal(t, err, ErrLineBufferOverflow)
+}
+
+func TestOutputConsistent(t *testing.T) {
+	cmd := NewCommand("for i in $(seq 1 1000); do echo out $i; echo err $i >&2; done")
+	cmd.Run()
+	assert.Nil(t, cmd.Status.Error)
+
+	assert.Equal(t, len(cmd.Status.Output), len(cmd.Status.Stdout)+len(cmd.Status.Stderr))
+	assert.Equal(t, int64(len(cmd.Status.Stdout)), cmd.Status.StdoutBytes)
+	assert.Equal(t, int64(len(cmd.Status.Stderr)), cmd.Status.StderrBytes)
+	assert.Contains(t, cmd.Status.Stdout, "out 1000\n")
+	assert.Contains(t, cmd.Status.Stderr, "err 1000\n")
+	assert.NotContains(t, cmd.Status.Stdout, "err")
+}
+
+func TestRestart(t *testing.T) {
+	var exits int32
+	cmd := NewCommand("trap 'exit 0' TERM; echo started; sleep 10 & wait", WithSetDir("."), WithOnComplete(func(Status) {
+		atomic.AddInt32(&exits, 1)
+	}))
+	assert.Nil(t, cmd.Start())
+	time.Sleep(100 * time.Millisecond)
+	oldPid := cmd.stdcmd.Process.Pid
+
+	start := time.Now()
+	assert.Nil(t, cmd.Restart())
+	assert.Less(t, time.Since(start).Seconds(), float64(2)) // exited on SIGTERM, not killed after the grace
+	newPid := cmd.stdcmd.Process.Pid
+	assert.NotEqual(t, newPid, oldPid)
+	assert.Equal(t, syscall.Kill(oldPid, 0), syscall.ESRCH)
+	assert.Nil(t, syscall.Kill(newPid, 0))
+	assert.Equal(t, atomic.LoadInt32(&exits), int32(0))
+
+	time.Sleep(100 * time.Millisecond)
+	cmd.Stop()
+	cmd.Wait()
+	<-cmd.exited
+	assert.Equal(t, cmd.Status.PID, newPid)
+	assert.Equal(t, cmd.Status.Output, "started\n")
+	assert.Equal(t, atomic.LoadInt32(&exits), int32(1))
+
+	// the status set by the options is kept
+	wd, _ := os.Getwd()
+	assert.Equal(t, cmd.Status.ResolvedDir, wd)
+}
+
+func TestWithOutputCapacity(t *testing.T) {
+	cmd := NewCommand("head -c 100000 /dev/zero", WithOutputCapacity(1<<20))
+	cmd.Run()
+	assert.Nil(t, cmd.Status.Error)
+	assert.Equal(t, len(cmd.Status.Stdout), 100000)
+	assert.Equal(t, cmd.Status.Output, cmd.Status.Stdout)
+	assert.GreaterOrEqual(t, cmd.stdout.Cap(), 1<<20)
+}
+
+func BenchmarkOutputCapacity(b *testing.B) {
+	const size = 8 << 20
+	script := fmt.Sprintf("head -c %d /dev/zero", size)
+
+	run := func(b *testing.B, options ...optionFunc) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			NewCommand(script, options...).Run()
+		}
+	}
+
+	b.Run("default", func(b *testing.B) {
+		run(b)
+	})
+	b.Run("presized", func(b *testing.B) {
+		run(b, WithOutputCapacity(size))
+	})
+}
+
+func TestWithOutputStream(t *testing.T) {
+	stdout := NewOutputStream(make(chan string))
+	stderr := NewOutputStream(make(chan string, 100))
+	stderr.SetHighWaterMark(10)
+
+	cmd := NewCommand("echo a; echo b >&2; echo c; printf d", WithOutputStream(stdout, stderr))
+	cmd.Start()
+
+	var lines []string
+	for line := range stdout.Lines() {
+		lines = append(lines, line)
+	}
+	assert.Equal(t, lines, []string{"a", "c", "d"})
+
+	lines = nil
+	for line := range stderr.Lines() {
+		lines = append(lines, line)
+	}
+	assert.Equal(t, lines, []string{"b"})
+
+	cmd.Wait()
+	assert.Equal(t, cmd.Status.Stdout, "a\nc\nd")
+
+	// Close by the caller after the exit, as SetHighWaterMark asks, doesn't panic
+	assert.NotPanics(t, func() {
+		stderr.Close()
+		stderr.Close()
+	})
+}
+
+func TestOutputStreamRateLimit(t *testing.T) {
+	stdoutChan := make(chan string, 100)
+	stdout := NewOutputStream(stdoutChan, WithRateLimit(50))
+
+	cmd := exec.Command("bash", "-c", "seq 1 20")
+	cmd.Stdout = stdout
+	start := time.Now()
+	cmd.Run()
+
+	// 20 lines at 50 lines/s, the first one isn't delayed
+	assert.GreaterOrEqual(t, time.Since(start).Seconds(), 0.35)
+	assert.Equal(t, len(stdoutChan), 20)
+	assert.Equal(t, stdout.Dropped(), int64(0))
+
+	stdoutChan = make(chan string, 10000)
+	stdout = NewOutputStream(stdoutChan, WithRateLimit(10), WithRateLimitDrop())
+	cmd = exec.Command("bash", "-c", "seq 1 10000")
+	cmd.Stdout = stdout
+	start = time.Now()
+	cmd.Run()
+
+	assert.Less(t, time.Since(start).Seconds(), float64(1))
+	delivered := int64(len(stdoutChan))
+	assert.GreaterOrEqual(t, delivered, int64(1))
+	assert.Less(t, delivered, int64(20))
+	assert.Equal(t, stdout.Dropped()+delivered, int64(10000))
+}
+
+func TestOutputStreamRateLimitConcurrent(t *testing.T) {
+	// the lines are paced across the senders, run with -race
+	streamChan := make(chan string, 100)
+	stream := NewOutputStream(streamChan, WithRateLimit(100))
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				stream.send("line")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 20 lines at 100 lines/s, the first one isn't delayed
+	assert.GreaterOrEqual(t, time.Since(start).Seconds(), 0.18)
+	assert.Equal(t, len(streamChan), 20)
+}
@@ -0,0 +1,165 @@
+package shell
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrSSHHostKeyNotSet the host key isn't verified, set WithSSHHostKeyCallback or WithSSHInsecureIgnoreHostKey
+var ErrSSHHostKeyNotSet = errors.New("ssh host key callback isn't set")
+
+// SSHRunner run the command on a remote host over ssh, implements Executor.
+type SSHRunner struct {
+	addr    string
+	config  *ssh.ClientConfig
+	timeout int // unit second, 0 is no limit
+}
+
+type sshOption func(*SSHRunner) error
+
+// WithSSHPassword auth with password
+func WithSSHPassword(password string) sshOption {
+	return func(r *SSHRunner) error {
+		r.config.Auth = append(r.config.Auth, ssh.Password(password))
+		return nil
+	}
+}
+
+// WithSSHKey auth with the pem encoded private key
+func WithSSHKey(pemBytes []byte) sshOption {
+	return func(r *SSHRunner) error {
+		signer, err := ssh.ParsePrivateKey(pemBytes)
+		if err != nil {
+			return errors.Errorf("parse ssh private key failed, err: %s", err.Error())
+		}
+		r.config.Auth = append(r.config.Auth, ssh.PublicKeys(signer))
+		return nil
+	}
+}
+
+// WithSSHHostKeyCallback verify the host key, example: the callback of golang.org/x/crypto/ssh/knownhosts.
+// it's required, NewSSHRunner fails without it.
+func WithSSHHostKeyCallback(callback ssh.HostKeyCallback) sshOption {
+	return func(r *SSHRunner) error {
+		r.config.HostKeyCallback = callback
+		return nil
+	}
+}
+
+// WithSSHInsecureIgnoreHostKey accept any host key, it's open to the man-in-the-middle attack, only for the test.
+func WithSSHInsecureIgnoreHostKey() sshOption {
+	return func(r *SSHRunner) error {
+		r.config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return nil
+	}
+}
+
+// WithSSHDialTimeout connect timeout
+func WithSSHDialTimeout(td time.Duration) sshOption {
+	return func(r *SSHRunner) error {
+		r.config.Timeout = td
+		return nil
+	}
+}
+
+// WithSSHTimeout command timeout, unit second
+func WithSSHTimeout(td int) sshOption {
+	if td < 0 {
+		panic("timeout > 0")
+	}
+
+	return func(r *SSHRunner) error {
+		r.timeout = td
+		return nil
+	}
+}
+
+// NewSSHRunner create runner for the remote host addr, the host key callback is required, example:
+// NewSSHRunner("10.0.0.1:22", "root", WithSSHPassword("xxx"), WithSSHHostKeyCallback(callback))
+func NewSSHRunner(addr, user string, options ...sshOption) (*SSHRunner, error) {
+	r := &SSHRunner{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:    user,
+			Timeout: 10 * time.Second,
+		},
+	}
+	for _, opt := range options {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+	if r.config.HostKeyCallback == nil {
+		return nil, ErrSSHHostKeyNotSet
+	}
+	return r, nil
+}
+
+// Command run args on the remote host, return CombinedOutput, exitcode, err
+func (r *SSHRunner) Command(args string) (string, int, error) {
+	client, err := ssh.Dial("tcp", r.addr, r.config)
+	if err != nil {
+		return "", DefaultExitCode, errors.Errorf("ssh dial %s failed, err: %s", r.addr, err.Error())
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", DefaultExitCode, errors.Errorf("ssh new session failed, err: %s", err.Error())
+	}
+	defer session.Close()
+
+	// stdout and stderr are copied in two goroutines by the session
+	var output syncBuffer
+	session.Stdout = &output
+	session.Stderr = &output
+
+	if err := session.Start(args); err != nil {
+		return "", DefaultExitCode, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if r.timeout > 0 {
+		timer := time.NewTimer(time.Duration(r.timeout) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case err = <-done:
+	case <-timeout:
+		session.Signal(ssh.SIGKILL)
+		client.Close()
+		<-done
+		return output.String(), DefaultExitCode, ErrProcessTimeout
+	}
+
+	if err == nil {
+		return output.String(), 0, nil
+	}
+
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return output.String(), exitErr.ExitStatus(), exitCodeError(exitErr.ExitStatus(), err)
+	}
+	return output.String(), DefaultExitCode, err
+}
+
+// exitCodeError map the remote shell exit code to the sentinel errors
+func exitCodeError(code int, err error) error {
+	switch code {
+	case 127:
+		return ErrNotFoundCommand
+	case 126:
+		return ErrNotExecutePermission
+	case 128:
+		return ErrInvalidArgs
+	}
+	return err
+}
@@ -0,0 +1,229 @@
+package shell
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// mockSSHServer accept password "secret" or the client key, reply the exec requests with the fake results.
+type mockSSHServer struct {
+	listener  net.Listener
+	config    *ssh.ServerConfig
+	clientKey ssh.PublicKey
+	hostKey   ssh.PublicKey
+	commands  chan string
+}
+
+func newMockSSHServer(t *testing.T, clientKey ssh.PublicKey) *mockSSHServer {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	assert.Nil(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	srv := &mockSSHServer{
+		listener:  ln,
+		clientKey: clientKey,
+		hostKey:   hostSigner.PublicKey(),
+		commands:  make(chan string, 10),
+	}
+	srv.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "root" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("invalid password")
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if srv.clientKey != nil && bytes.Equal(key.Marshal(), srv.clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("invalid key")
+		},
+	}
+	srv.config.AddHostKey(hostSigner)
+
+	go srv.serve()
+	return srv
+}
+
+// HostKeyOption verify the host key of the server
+func (s *mockSSHServer) HostKeyOption() sshOption {
+	return WithSSHHostKeyCallback(ssh.FixedHostKey(s.hostKey))
+}
+
+func (s *mockSSHServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *mockSSHServer) Close() {
+	s.listener.Close()
+}
+
+func (s *mockSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+
+			for newChan := range chans {
+				if newChan.ChannelType() != "session" {
+					newChan.Reject(ssh.UnknownChannelType, "only session")
+					continue
+				}
+				go s.handleSession(newChan)
+			}
+		}()
+	}
+}
+
+func (s *mockSSHServer) handleSession(newChan ssh.NewChannel) {
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+
+		var payload struct{ Command string }
+		ssh.Unmarshal(req.Payload, &payload)
+		req.Reply(true, nil)
+		s.commands <- payload.Command
+
+		var code uint32
+		switch payload.Command {
+		case "hostname":
+			channel.Write([]byte("mock-host\n"))
+		case "fail":
+			channel.Stderr().Write([]byte("boom\n"))
+			code = 3
+		case "sleep":
+			time.Sleep(3 * time.Second)
+		}
+
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{code}))
+		return
+	}
+}
+
+func TestSSHRunnerPassword(t *testing.T) {
+	srv := newMockSSHServer(t, nil)
+	defer srv.Close()
+
+	var runner Executor
+	runner, err := NewSSHRunner(srv.Addr(), "root", WithSSHPassword("secret"), srv.HostKeyOption())
+	assert.Nil(t, err)
+
+	out, code, err := runner.Command("hostname")
+	assert.Nil(t, err)
+	assert.Equal(t, code, 0)
+	assert.Equal(t, out, "mock-host\n")
+	assert.Equal(t, <-srv.commands, "hostname")
+
+	out, code, err = runner.Command("fail")
+	assert.NotNil(t, err)
+	assert.Equal(t, code, 3)
+	assert.Equal(t, out, "boom\n")
+
+	runner, err = NewSSHRunner(srv.Addr(), "root", WithSSHPassword("wrong"), srv.HostKeyOption())
+	assert.Nil(t, err)
+	_, _, err = runner.Command("hostname")
+	assert.NotNil(t, err)
+}
+
+func TestSSHRunnerKey(t *testing.T) {
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	assert.Nil(t, err)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	pub, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	assert.Nil(t, err)
+	srv := newMockSSHServer(t, pub)
+	defer srv.Close()
+
+	runner, err := NewSSHRunner(srv.Addr(), "deploy", WithSSHKey(pemBytes), srv.HostKeyOption())
+	assert.Nil(t, err)
+	out, code, err := runner.Command("hostname")
+	assert.Nil(t, err)
+	assert.Equal(t, code, 0)
+	assert.Equal(t, out, "mock-host\n")
+
+	_, err = NewSSHRunner(srv.Addr(), "deploy", WithSSHKey([]byte("invalid")), srv.HostKeyOption())
+	assert.NotNil(t, err)
+}
+
+func TestSSHRunnerTimeout(t *testing.T) {
+	srv := newMockSSHServer(t, nil)
+	defer srv.Close()
+
+	runner, err := NewSSHRunner(srv.Addr(), "root", WithSSHPassword("secret"), srv.HostKeyOption(), WithSSHTimeout(1))
+	assert.Nil(t, err)
+
+	start := time.Now()
+	_, _, err = runner.Command("sleep")
+	assert.Equal(t, err, ErrProcessTimeout)
+	assert.Less(t, time.Since(start).Seconds(), float64(2))
+}
+
+func TestSSHRunnerHostKey(t *testing.T) {
+	srv := newMockSSHServer(t, nil)
+	defer srv.Close()
+
+	// fail closed without the host key callback
+	_, err := NewSSHRunner(srv.Addr(), "root", WithSSHPassword("secret"))
+	assert.Equal(t, err, ErrSSHHostKeyNotSet)
+
+	// the other host key is rejected
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	otherPub, err := ssh.NewPublicKey(&otherKey.PublicKey)
+	assert.Nil(t, err)
+	runner, err := NewSSHRunner(srv.Addr(), "root", WithSSHPassword("secret"),
+		WithSSHHostKeyCallback(ssh.FixedHostKey(otherPub)))
+	assert.Nil(t, err)
+	_, _, err = runner.Command("hostname")
+	assert.NotNil(t, err)
+
+	runner, err = NewSSHRunner(srv.Addr(), "root", WithSSHPassword("secret"), WithSSHInsecureIgnoreHostKey())
+	assert.Nil(t, err)
+	out, _, err := runner.Command("hostname")
+	assert.Nil(t, err)
+	assert.Equal(t, out, "mock-host\n")
+}
+
+func TestLocalExecutor(t *testing.T) {
+	var runner Executor = LocalExecutor{}
+	out, code, err := runner.Command("echo -n 123")
+	assert.Nil(t, err)
+	assert.Equal(t, code, 0)
+	assert.Equal(t, out, "123")
+}
@@ -2,6 +2,10 @@ package shell
 
 import (
 	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,6 +19,9 @@ const (
 
 var (
 	randsrc = rand.NewSource(time.Now().UnixNano())
+
+	// chdirLock serialize RunInDir, the work dir is process-global
+	chdirLock sync.Mutex
 )
 
 // randString fast get rand string, time cost 200 ns
@@ -34,3 +41,72 @@ func randString(n int) string {
 	}
 	return string(b)
 }
+
+// compareVersion compare the dot separated versions, return -1, 0, 1. the missing parts are 0,
+// the non numeric suffix of a part is ignored, example: 1.2.3-rc1 == 1.2.3
+func compareVersion(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = leadingInt(as[i])
+		}
+		if i < len(bs) {
+			y = leadingInt(bs[i])
+		}
+
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+func leadingInt(s string) int {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	n, _ := strconv.Atoi(s[:end])
+	return n
+}
+
+// Quote shell-escape arg for safe interpolation into `bash -c`, wrap it in single quotes.
+func Quote(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// QuoteJoin quote every arg and join them with space
+func QuoteJoin(args ...string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, Quote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// RunInDir change the process work dir to dir while fn runs, the work dir is restored
+// even if fn panics. the calls are serialized, the other goroutines still see the changed dir.
+func RunInDir(dir string, fn func() error) error {
+	chdirLock.Lock()
+	defer chdirLock.Unlock()
+
+	origin, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	defer os.Chdir(origin)
+
+	return fn()
+}
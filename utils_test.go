@@ -0,0 +1,79 @@
+package shell
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuote(t *testing.T) {
+	cases := []string{
+		"",
+		"hello world",
+		"it's",
+		"'single' \"double\"",
+		"$HOME ${PATH}",
+		"`id`",
+		"a; echo injected",
+		"$(echo injected) && ls | wc",
+	}
+
+	for _, arg := range cases {
+		out, code, err := Command("printf %s " + Quote(arg))
+		assert.Nil(t, err)
+		assert.Equal(t, code, 0)
+		assert.Equal(t, out, arg)
+	}
+
+	assert.Equal(t, Quote("it's"), `'it'\''s'`)
+}
+
+func TestQuoteJoin(t *testing.T) {
+	args := []string{"a b", "c;d", "$e", "`f`"}
+	out, _, err := Command("printf '%s\\n' " + QuoteJoin(args...))
+	assert.Nil(t, err)
+	assert.Equal(t, out, "a b\nc;d\n$e\n`f`\n")
+}
+
+func TestRunInDir(t *testing.T) {
+	origin, err := os.Getwd()
+	assert.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "go-shell-dir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+	ioutil.WriteFile(dir+"/script.sh", []byte("echo -n in-dir"), 0644)
+
+	err = RunInDir(dir, func() error {
+		out, _, err := Command("bash ./script.sh")
+		assert.Equal(t, out, "in-dir")
+		return err
+	})
+	assert.Nil(t, err)
+
+	errFn := errors.New("fn error")
+	err = RunInDir(dir, func() error { return errFn })
+	assert.Equal(t, err, errFn)
+
+	func() {
+		defer func() {
+			assert.Equal(t, recover(), "fn panic")
+		}()
+		RunInDir(dir, func() error {
+			wd, _ := os.Getwd()
+			assert.Equal(t, wd, dir)
+			panic("fn panic")
+		})
+	}()
+
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	assert.Equal(t, wd, origin)
+
+	assert.NotNil(t, RunInDir("/not-exist-dir", func() error { return nil }))
+}
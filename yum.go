@@ -1,9 +1,17 @@
 package shell
 
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
 type Yum struct {
-	cmd     *Cmd
-	pkg     string
-	timeout int
+	cmd         *Cmd
+	pkg         string
+	timeout     int
+	keepRunning bool
+	cmdOptions  []optionFunc
 }
 
 type yumOption func(*Yum) error
@@ -15,6 +23,22 @@ func WithYumTimeout(timeout int) yumOption {
 	}
 }
 
+// WithYumCmdOptions apply the regular Cmd options to the yum command, example: WithSetEnv for the proxy vars
+func WithYumCmdOptions(options ...optionFunc) yumOption {
+	return func(y *Yum) error {
+		y.cmdOptions = append(y.cmdOptions, options...)
+		return nil
+	}
+}
+
+// WithYumKeepRunning don't stop yum when the context of ThenContext is done
+func WithYumKeepRunning() yumOption {
+	return func(y *Yum) error {
+		y.keepRunning = true
+		return nil
+	}
+}
+
 func NewYumCommand(pkg string, options ...yumOption) *Yum {
 	yum := &Yum{
 		pkg:     pkg,
@@ -25,11 +49,12 @@ func NewYumCommand(pkg string, options ...yumOption) *Yum {
 		opt(yum)
 	}
 
+	cmdOptions := []optionFunc{WithShellMode()}
 	if yum.timeout > 0 {
-		yum.cmd = NewCommand("yum install -y "+yum.pkg, WithShellMode(), WithTimeout(yum.timeout))
-	} else {
-		yum.cmd = NewCommand("yum install -y "+yum.pkg, WithShellMode())
+		cmdOptions = append(cmdOptions, WithTimeout(yum.timeout))
 	}
+	cmdOptions = append(cmdOptions, yum.cmdOptions...)
+	yum.cmd = NewCommand("yum install -y "+yum.pkg, cmdOptions...)
 
 	return yum
 }
@@ -80,3 +105,43 @@ func (y *Yum) Then(f func(string, error)) {
 		f(res, err)
 	}(y)
 }
+
+// ThenContext call f with the yum result, or with ctx.Err() when ctx is done first, yum is stopped then
+// unless WithYumKeepRunning. the panic of f is recovered and sent as an error to the returned chan,
+// the chan is closed after f returns.
+func (y *Yum) ThenContext(ctx context.Context, f func(string, error)) <-chan error {
+	panicErr := make(chan error, 1)
+
+	go func(y *Yum) {
+		defer close(panicErr)
+		defer func() {
+			if r := recover(); r != nil {
+				y.cmd.logf("then callback panic: %v", r)
+				panicErr <- errors.Errorf("then callback panic: %v", r)
+			}
+		}()
+
+		results := make(chan yumResult, 1)
+		go func() {
+			res, err := y.YumWait()
+			results <- yumResult{res: res, err: err}
+		}()
+
+		select {
+		case result := <-results:
+			f(result.res, result.err)
+
+		case <-ctx.Done():
+			if !y.keepRunning {
+				y.cmd.Stop()
+			}
+			f("", ctx.Err())
+		}
+	}(y)
+	return panicErr
+}
+
+type yumResult struct {
+	res string
+	err error
+}
@@ -0,0 +1,68 @@
+package shell
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestYumThenContext(t *testing.T) {
+	y := &Yum{cmd: NewCommand("sleep 5")}
+	y.YumInstallStart()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	y.ThenContext(ctx, func(res string, err error) {
+		result <- err
+	})
+
+	start := time.Now()
+	cancel()
+	assert.Equal(t, <-result, context.Canceled)
+	assert.Less(t, time.Since(start).Seconds(), float64(1))
+
+	y.YumWait()
+	assert.Equal(t, y.cmd.Status.Finish, true)
+}
+
+func TestYumThenContextRecover(t *testing.T) {
+	y := &Yum{cmd: NewCommand("echo -n 123")}
+	y.YumInstallStart()
+
+	result := make(chan string, 1)
+	panicErr := y.ThenContext(context.Background(), func(res string, err error) {
+		result <- res
+		panic("callback panic")
+	})
+
+	assert.Equal(t, <-result, "123")
+	err := <-panicErr
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "callback panic")
+
+	// nil when the callback returns normally
+	panicErr = y.ThenContext(context.Background(), func(string, error) {})
+	assert.Nil(t, <-panicErr)
+}
+
+func TestYumCmdOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-shell-yum")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(dir+"/yum", []byte("#!/bin/sh\nprintf '%s via %s' \"$*\" \"$HTTP_PROXY\"\n"), 0755)
+	assert.Nil(t, err)
+
+	y := NewYumCommand("docker", WithYumCmdOptions(
+		WithEnvMap(map[string]string{"HTTP_PROXY": "http://proxy:3128"}, true),
+		WithPathPrepend(dir),
+	))
+	y.YumInstallStart()
+	out, err := y.YumWait()
+
+	assert.Nil(t, err)
+	assert.Equal(t, out, "install -y docker via http://proxy:3128")
+}